@@ -3,6 +3,7 @@
 package cfgloader
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,24 +13,138 @@ import (
 
 	"github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
 	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
-	"gopkg.in/yaml.v2"
+	"github.com/G-Research/prometheus-config-loader/lint"
+	"github.com/G-Research/prometheus-config-loader/strictyaml"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// FileError describes a problem with a single rule file. Group and
+// Rule are only set if the problem is with a specific group or rule.
+type FileError struct {
+	File  string
+	Group string
+	// Index of the rule within its group, starting at 0, or -1 if the
+	// problem is not with a single rule
+	Rule int
+	Err  error
+}
+
+func (e FileError) Error() string {
+	var parts []string
+	if e.File != "" {
+		parts = append(parts, e.File)
+	}
+	switch {
+	case e.Group != "" && e.Rule >= 0:
+		parts = append(parts, fmt.Sprintf("group %q, rule %d", e.Group, e.Rule))
+	case e.Group != "":
+		parts = append(parts, fmt.Sprintf("group %q", e.Group))
+	}
+	parts = append(parts, e.Err.Error())
+	return strings.Join(parts, ": ")
+}
+
+// LoadErrors collects all problems found loading one or more rule
+// files.
+type LoadErrors []FileError
+
+func (l LoadErrors) Error() string {
+	var msgs []string
+	for _, err := range l {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// asLoadErrors turns any error from loading the named file into
+// LoadErrors.
+func asLoadErrors(file string, err error) LoadErrors {
+	switch e := err.(type) {
+	case LoadErrors:
+		return e
+	case FileError:
+		return LoadErrors{e}
+	}
+	return LoadErrors{{File: file, Rule: -1, Err: err}}
+}
+
 // LoadConfigurationDirectory loads all the YAML files in a directory
-// and reurns a PrometheusRuleList object, suitable for sending to a
-// kubernetes API server.
+// tree and reurns a PrometheusRuleList object, suitable for sending to
+// a kubernetes API server, using the default naming. See
+// Loader.LoadDirectory.
+func LoadConfigurationDirectory(directory, namespace, prometheus string) (*v1.PrometheusRuleList, error) {
+	l := &Loader{Namespace: namespace, Prometheus: prometheus, Strict: true}
+	return l.LoadDirectory(directory)
+}
+
+// Loader loads rule files into PrometheusRules for a prometheus, in a
+// namespace. Every PrometheusRule gets the labels selecting the rules
+// for the prometheus, see RuleSelector, and is named by NameTemplate.
+// Extra labels and annotations can be added, their values are
+// templates too. The templates are text/template templates, expanded
+// with NameData for each rule file.
+type Loader struct {
+	Namespace  string
+	Prometheus string
+	// If empty, DefaultNameTemplate is used
+	NameTemplate string
+	Labels       map[string]string
+	Annotations  map[string]string
+	// If set, the rules are only ever written out as rule files, so
+	// the fields the PrometheusRule CRD can not represent are kept,
+	// see RuleFileFieldsAnnotation, rather than rejected.
+	RuleFiles bool
+	// If set, rule files with unknown fields or duplicate keys are
+	// rejected
+	Strict bool
+	// If set, rule files that would make a PrometheusRule larger than
+	// the size limit are split into several PrometheusRules, rather
+	// than rejected, see checkSize
+	SplitOversized bool
+	// The size limit, in bytes. If zero, MaxObjectSize is used
+	MaxObjectSize int
+	// Bytes kept free below the size limit, for annotations added to
+	// the PrometheusRules after loading them
+	Reserve int
+}
+
+// LoadDirectory loads all the YAML files in a directory tree and
+// returns a PrometheusRuleList object, suitable for sending to a
+// kubernetes API server. Directories named "tests" hold unit tests,
+// and are skipped.
 //
-// It will generate these to be suitable for the named prometheus, in
-// the given namespace.
+// Files in subdirectories are named after their path relative to the
+// directory, so with the default template "team/app.yaml" becomes
+// "<prometheus>-team-app-rules". Names must be valid DNS-1123
+// subdomains, and unique.
+//
+// PrometheusRules larger than the size limit are an error or, with
+// SplitOversized, split into parts, see checkSize.
 //
 // If any errors occur while loading the individual PrometheusRules,
-// the prometheusRule will not be added, and the last error that
-// occured will be the error returned from the function.
-func LoadConfigurationDirectory(directory, namespace, prometheus string) (*v1.PrometheusRuleList, error) {
-	var errSeen error = nil
-	glob := filepath.Join(directory, "*.yaml")
-	names, err := filepath.Glob(glob)
+// the prometheusRule will not be added. All errors from all files are
+// returned as LoadErrors.
+func (l *Loader) LoadDirectory(directory string) (*v1.PrometheusRuleList, error) {
+	n, err := l.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs LoadErrors
+	var names []string
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "tests" && path != directory {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && filepath.Ext(path) == ".yaml" {
+			names = append(names, path)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -38,26 +153,100 @@ func LoadConfigurationDirectory(directory, namespace, prometheus string) (*v1.Pr
 	}
 
 	rv := v1.PrometheusRuleList{}
+	seen := make(map[string]string)
 
 	for _, name := range names {
-		rule, err := LoadConfigurationFile(name, namespace, prometheus)
+		rel, err := filepath.Rel(directory, name)
 		if err != nil {
-			errSeen = err
-		} else {
-			rv.Items = append(rv.Items, rule)
+			errs = append(errs, asLoadErrors(name, err)...)
+			continue
 		}
+		data := n.data(rel)
+		ruleName, err := n.ruleName(data)
+		if err != nil {
+			errs = append(errs, asLoadErrors(name, err)...)
+			continue
+		}
+		if other, ok := seen[ruleName]; ok {
+			errs = append(errs, FileError{File: name, Rule: -1, Err: fmt.Errorf("%s would also be loaded as %s", other, ruleName)})
+			continue
+		}
+		seen[ruleName] = rel
+
+		rule, err := l.loadFile(name, ruleName)
+		if err != nil {
+			errs = append(errs, asLoadErrors(name, err)...)
+			continue
+		}
+		if err := n.decorate(rule, data); err != nil {
+			errs = append(errs, asLoadErrors(name, err)...)
+			continue
+		}
+		parts, err := l.checkSize(name, rule)
+		if err != nil {
+			errs = append(errs, asLoadErrors(name, err)...)
+			continue
+		}
+		for _, part := range parts {
+			if part.GetName() == ruleName {
+				continue
+			}
+			if err := validateName(part.GetName()); err != nil {
+				errs = append(errs, asLoadErrors(name, err)...)
+			}
+			if other, ok := seen[part.GetName()]; ok {
+				errs = append(errs, FileError{File: name, Rule: -1, Err: fmt.Errorf("%s would also be loaded as %s", other, part.GetName())})
+			}
+			seen[part.GetName()] = rel
+		}
+		rv.Items = append(rv.Items, parts...)
 	}
 
-	return &rv, errSeen
+	if len(errs) > 0 {
+		return &rv, errs
+	}
+	return &rv, nil
 }
 
 // Construct the PrometheusRule name based on the prometheus it is
 // for, and the base file name of the rules. This expects that the
 // file name ends in ".yaml".
 func buildRuleName(fileName, prometheus string) string {
+	return fmt.Sprintf("%s-%s-rules", prometheus, fileBaseName(fileName))
+}
+
+// fileBaseName returns the base name of a rule file, without ".yaml",
+// with dots replaced by dashes.
+func fileBaseName(fileName string) string {
 	base := filepath.Base(fileName)
-	base = strings.ReplaceAll(base[:len(base)-5], ".", "-")
-	return fmt.Sprintf("%s-%s-rules", prometheus, base)
+	return strings.ReplaceAll(base[:len(base)-5], ".", "-")
+}
+
+// buildRelativeRuleName is buildRuleName for a file given by its path
+// relative to the top of a rules directory, with the directories
+// becoming part of the name.
+func buildRelativeRuleName(rel, prometheus string) string {
+	return buildRuleName(relativeFileName(rel), prometheus)
+}
+
+// relativeFileName turns the path of a rule file, relative to the top
+// of a rules directory, into a file name, with the directories
+// becoming part of it.
+func relativeFileName(rel string) string {
+	return strings.ReplaceAll(filepath.ToSlash(rel), "/", ".")
+}
+
+// ruleLabels returns the labels set on every PrometheusRule generated
+// for the named prometheus.
+func ruleLabels(prometheus string) map[string]string {
+	return map[string]string{"prometheus": prometheus, "role": "prometheus-rulefiles"}
+}
+
+// RuleSelector returns a label selector matching all PrometheusRule
+// objects that LoadConfigurationFile would generate for the named
+// prometheus.
+func RuleSelector(prometheus string) string {
+	return labels.SelectorFromSet(ruleLabels(prometheus)).String()
 }
 
 // LoadConfigurationFile loads a configuration file into a
@@ -68,6 +257,13 @@ func buildRuleName(fileName, prometheus string) string {
 // In case of an error occuring, the returned PrometheusRule could be
 // nil, working, or in a broken state.
 func LoadConfigurationFile(name, namespace, prometheus string) (*v1.PrometheusRule, error) {
+	l := &Loader{Namespace: namespace, Prometheus: prometheus, Strict: true}
+	return l.loadFile(name, buildRuleName(name, prometheus))
+}
+
+// loadFile does the work for LoadConfigurationFile, giving the
+// resulting PrometheusRule the name ruleName.
+func (l *Loader) loadFile(name, ruleName string) (*v1.PrometheusRule, error) {
 	f, err := os.Open(name)
 	defer f.Close()
 	if err != nil {
@@ -79,36 +275,72 @@ func LoadConfigurationFile(name, namespace, prometheus string) (*v1.PrometheusRu
 		return nil, err
 	}
 
-	spec, err := ParseRuleSpec(data)
+	spec, fields, err := l.parseRuleSpec(name, data)
 	if err != nil {
 		return nil, err
 	}
 
 	rv := &v1.PrometheusRule{Spec: spec}
-	rv.SetNamespace(namespace)
-	rv.SetName(buildRuleName(name, prometheus))
-	labels := map[string]string{"prometheus": prometheus, "role": "prometheus-rulefiles"}
-	rv.SetLabels(labels)
+	rv.SetNamespace(l.Namespace)
+	rv.SetName(ruleName)
+	rv.SetLabels(ruleLabels(l.Prometheus))
+	if len(fields) > 0 {
+		buf, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		rv.SetAnnotations(map[string]string{RuleFileFieldsAnnotation: string(buf)})
+	}
 
 	return rv, err
 }
 
+// ParseRuleSpec parses the contents of a prometheus rule file into a
+// PrometheusRuleSpec. Group labels are merged into the labels of every
+// rule in the group, with the rule's own labels taking precedence.
+// The lint.SuppressAnnotation annotation is only meant for the linter,
+// and is dropped. Fields that the PrometheusRule CRD cannot represent
+// cause an error, rather than being silently dropped.
 func ParseRuleSpec(data []byte) (v1.PrometheusRuleSpec, error) {
+	l := &Loader{Strict: true}
+	rv, _, err := l.parseRuleSpec("", data)
+	return rv, err
+}
+
+// parseRuleSpec does the work for ParseRuleSpec, the file name is only
+// used for error messages. Any problems found are returned as
+// LoadErrors. If RuleFiles is set, the fields the CRD can not
+// represent are returned, by group name, instead of being an error.
+func (l *Loader) parseRuleSpec(name string, data []byte) (v1.PrometheusRuleSpec, map[string]groupFields, error) {
 	var intermediate rulefmt.RuleGroups
 	var rv v1.PrometheusRuleSpec
 
-	err := yaml.Unmarshal(data, &intermediate)
-
+	err := strictyaml.Unmarshal("", data, &intermediate, l.Strict)
+	if yamlErrs, ok := err.(strictyaml.Errors); ok {
+		var errs LoadErrors
+		for _, yamlErr := range yamlErrs {
+			errs = append(errs, FileError{File: name, Rule: -1, Err: yamlErr})
+		}
+		return rv, nil, errs
+	}
 	if err != nil {
-		return rv, err
+		return rv, nil, asLoadErrors(name, err)
 	}
 
 	if len(intermediate.Groups) == 0 {
-		// TODO: consider creating a custom error?
-		return rv, errors.New("No groups found")
+		return rv, nil, asLoadErrors(name, errors.New("No groups found"))
 	}
 
+	var errs LoadErrors
+	fields := make(map[string]groupFields)
 	for _, g := range intermediate.Groups {
+		f, extra := ruleFileFields(g)
+		switch {
+		case extra && l.RuleFiles:
+			fields[g.Name] = f
+		case extra:
+			errs = append(errs, checkRepresentable(name, g)...)
+		}
 		rg := v1.RuleGroup{Name: g.Name, Interval: g.Interval}
 		for _, r := range g.Rules {
 			tmp := v1.Rule{
@@ -116,13 +348,160 @@ func ParseRuleSpec(data []byte) (v1.PrometheusRuleSpec, error) {
 				Alert:       r.Alert,
 				Expr:        intstr.FromString(r.Expr),
 				For:         r.For,
-				Labels:      r.Labels,
-				Annotations: r.Annotations,
+				Labels:      mergeLabels(g.Labels, r.Labels),
+				Annotations: ruleAnnotations(r.Annotations),
 			}
 			rg.Rules = append(rg.Rules, tmp)
 		}
 		rv.Groups = append(rv.Groups, rg)
 	}
 
+	if len(errs) > 0 {
+		return rv, nil, errs
+	}
+	return rv, fields, nil
+}
+
+// RuleGroupsFromSpec converts a PrometheusRuleSpec back into the
+// contents of a prometheus rule file, the inverse of ParseRuleSpec.
+// Group labels have already been merged into the rules, so the groups
+// have none.
+func RuleGroupsFromSpec(spec v1.PrometheusRuleSpec) rulefmt.RuleGroups {
+	var rv rulefmt.RuleGroups
+	for _, g := range spec.Groups {
+		rg := rulefmt.RuleGroup{Name: g.Name, Interval: g.Interval}
+		for _, r := range g.Rules {
+			rg.Rules = append(rg.Rules, rulefmt.Rule{
+				Record:      r.Record,
+				Alert:       r.Alert,
+				Expr:        r.Expr.String(),
+				For:         r.For,
+				Labels:      r.Labels,
+				Annotations: ruleAnnotations(r.Annotations),
+			})
+		}
+		rv.Groups = append(rv.Groups, rg)
+	}
+	return rv
+}
+
+// RuleFileFieldsAnnotation holds, as JSON, the fields of the rule
+// groups in a PrometheusRule that the CRD can not represent, when it
+// is loaded for rule files. RuleGroupsFromRule puts them back.
+const RuleFileFieldsAnnotation = "prometheus-config-loader/rule-file-fields"
+
+// groupFields holds the fields of a rule group, and of its rules, that
+// the PrometheusRule CRD can not represent.
+type groupFields struct {
+	QueryOffset             string `json:"query_offset,omitempty"`
+	Limit                   int    `json:"limit,omitempty"`
+	PartialResponseStrategy string `json:"partial_response_strategy,omitempty"`
+	// keep_firing_for of each rule, in order
+	KeepFiringFor []string `json:"keep_firing_for,omitempty"`
+}
+
+// ruleFileFields returns the fields of g that the PrometheusRule CRD
+// can not represent, and whether it has any.
+func ruleFileFields(g rulefmt.RuleGroup) (groupFields, bool) {
+	rv := groupFields{QueryOffset: g.QueryOffset, Limit: g.Limit, PartialResponseStrategy: g.PartialResponseStrategy}
+	extra := g.QueryOffset != "" || g.Limit != 0 || g.PartialResponseStrategy != ""
+	for _, r := range g.Rules {
+		if r.KeepFiringFor != "" {
+			extra = true
+		}
+	}
+	if !extra {
+		return groupFields{}, false
+	}
+	for _, r := range g.Rules {
+		rv.KeepFiringFor = append(rv.KeepFiringFor, r.KeepFiringFor)
+	}
+	return rv, true
+}
+
+// RuleGroupsFromRule is RuleGroupsFromSpec for a PrometheusRule loaded
+// for rule files, also putting back the fields the CRD can not
+// represent, from RuleFileFieldsAnnotation.
+func RuleGroupsFromRule(rule *v1.PrometheusRule) (rulefmt.RuleGroups, error) {
+	rv := RuleGroupsFromSpec(rule.Spec)
+	text, ok := rule.GetAnnotations()[RuleFileFieldsAnnotation]
+	if !ok {
+		return rv, nil
+	}
+	var fields map[string]groupFields
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return rv, fmt.Errorf("invalid %s annotation on %s: %s", RuleFileFieldsAnnotation, rule.GetName(), err)
+	}
+	for ix := range rv.Groups {
+		g := &rv.Groups[ix]
+		f := fields[g.Name]
+		g.QueryOffset = f.QueryOffset
+		g.Limit = f.Limit
+		g.PartialResponseStrategy = f.PartialResponseStrategy
+		for rix := range g.Rules {
+			if rix < len(f.KeepFiringFor) {
+				g.Rules[rix].KeepFiringFor = f.KeepFiringFor[rix]
+			}
+		}
+	}
 	return rv, nil
 }
+
+// checkRepresentable returns an error for every field a rule group
+// uses that has no equivalent in the PrometheusRule CRD.
+func checkRepresentable(name string, g rulefmt.RuleGroup) LoadErrors {
+	var errs LoadErrors
+	unsupported := func(field string, rule int) {
+		errs = append(errs, FileError{File: name, Group: g.Name, Rule: rule, Err: fmt.Errorf("%s is not supported by the PrometheusRule CRD", field)})
+	}
+	if g.QueryOffset != "" {
+		unsupported("query_offset", -1)
+	}
+	if g.Limit != 0 {
+		unsupported("limit", -1)
+	}
+	if g.PartialResponseStrategy != "" {
+		unsupported("partial_response_strategy", -1)
+	}
+	for ix, r := range g.Rules {
+		if r.KeepFiringFor != "" {
+			unsupported("keep_firing_for", ix)
+		}
+	}
+	return errs
+}
+
+// mergeLabels returns the group labels overridden by the rule labels,
+// or nil if neither has any.
+func mergeLabels(group, rule map[string]string) map[string]string {
+	if len(group) == 0 {
+		return rule
+	}
+	rv := make(map[string]string)
+	for key, val := range group {
+		rv[key] = val
+	}
+	for key, val := range rule {
+		rv[key] = val
+	}
+	return rv
+}
+
+// ruleAnnotations returns the annotations of a rule, without the lint
+// suppression annotation.
+func ruleAnnotations(annotations map[string]string) map[string]string {
+	if _, ok := annotations[lint.SuppressAnnotation]; !ok {
+		return annotations
+	}
+	var rv map[string]string
+	for key, val := range annotations {
+		if key == lint.SuppressAnnotation {
+			continue
+		}
+		if rv == nil {
+			rv = make(map[string]string)
+		}
+		rv[key] = val
+	}
+	return rv
+}
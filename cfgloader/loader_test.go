@@ -2,7 +2,12 @@ package cfgloader
 
 import (
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 func TestBuildRulename(t *testing.T) {
@@ -24,6 +29,25 @@ func TestBuildRulename(t *testing.T) {
 	}
 }
 
+func TestBuildRelativeRulename(t *testing.T) {
+	cases := []struct {
+		filename   string
+		prometheus string
+		expected   string
+	}{
+		{"blah.yaml", "prom", "prom-blah-rules"},
+		{filepath.Join("team", "blah.yaml"), "prom", "prom-team-blah-rules"},
+		{filepath.Join("a", "b.c", "blah.yaml"), "prom", "prom-a-b-c-blah-rules"},
+	}
+
+	for ix, td := range cases {
+		seen := buildRelativeRuleName(td.filename, td.prometheus)
+		if td.expected != seen {
+			t.Errorf("Case %d, saw %s expected %s", ix, seen, td.expected)
+		}
+	}
+}
+
 func TestLoadDirectory(t *testing.T) {
 	cases := []struct {
 		directory string
@@ -45,6 +69,92 @@ func TestLoadDirectory(t *testing.T) {
 	}
 }
 
+func TestLoadDirectoryErrors(t *testing.T) {
+	_, err := LoadConfigurationDirectory("testdata", "namespace", "prom")
+	errs, ok := err.(LoadErrors)
+	if !ok {
+		t.Fatalf("Expected LoadErrors, saw %T (%v)", err, err)
+	}
+	var seen []string
+	for _, e := range errs {
+		seen = append(seen, filepath.Base(e.File))
+	}
+	if !reflect.DeepEqual(seen, []string{"rule4.yaml", "rule5.yaml"}) {
+		t.Errorf("Saw errors for %v, expected rule4.yaml and rule5.yaml:\n%s", seen, err)
+	}
+}
+
+func TestParseRuleSpecErrors(t *testing.T) {
+	data := "groups:\n- name: a\n  limit: 5\n  rules:\n  - record: b\n    expr: up\n- name: c\n  rules:\n  - record: d\n    expr: up\n  - alert: e\n    expr: up == 0\n    keep_firing_for: 5m\n"
+	_, _, err := (&Loader{Strict: true}).parseRuleSpec("rules.yaml", []byte(data))
+	errs, ok := err.(LoadErrors)
+	if !ok {
+		t.Fatalf("Expected LoadErrors, saw %T (%v)", err, err)
+	}
+	expected := []string{
+		`rules.yaml: group "a": limit is not supported by the PrometheusRule CRD`,
+		`rules.yaml: group "c", rule 1: keep_firing_for is not supported by the PrometheusRule CRD`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Saw %d errors, expected %d:\n%s", len(errs), len(expected), err)
+	}
+	for ix, e := range errs {
+		if e.Error() != expected[ix] {
+			t.Errorf("Error %d, saw %q expected %q", ix, e.Error(), expected[ix])
+		}
+	}
+	if errs[1].Group != "c" || errs[1].Rule != 1 {
+		t.Errorf("Unexpected location for %v", errs[1])
+	}
+}
+
+func TestParseRuleSpecRuleFiles(t *testing.T) {
+	data := "groups:\n- name: a\n  limit: 5\n  query_offset: 1m\n  partial_response_strategy: warn\n  rules:\n  - record: b\n    expr: up\n  - alert: c\n    expr: up == 0\n    keep_firing_for: 5m\n- name: d\n  rules:\n  - record: e\n    expr: up\n"
+	_, fields, err := (&Loader{Strict: true, RuleFiles: true}).parseRuleSpec("rules.yaml", []byte(data))
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	expected := map[string]groupFields{"a": {QueryOffset: "1m", Limit: 5, PartialResponseStrategy: "warn", KeepFiringFor: []string{"", "5m"}}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Saw fields %+v, expected %+v", fields, expected)
+	}
+
+	rule := &v1.PrometheusRule{}
+	rule.Spec, _ = ParseRuleSpec([]byte("groups:\n- name: a\n  rules:\n  - record: b\n    expr: up\n  - alert: c\n    expr: up == 0\n- name: d\n  rules:\n  - record: e\n    expr: up\n"))
+	rule.SetAnnotations(map[string]string{RuleFileFieldsAnnotation: `{"a":{"query_offset":"1m","limit":5,"partial_response_strategy":"warn","keep_firing_for":["","5m"]}}`})
+	groups, err := RuleGroupsFromRule(rule)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	a, d := groups.Groups[0], groups.Groups[1]
+	if a.QueryOffset != "1m" || a.Limit != 5 || a.PartialResponseStrategy != "warn" || a.Rules[0].KeepFiringFor != "" || a.Rules[1].KeepFiringFor != "5m" {
+		t.Errorf("Rule file fields not restored, %+v", a)
+	}
+	if d.QueryOffset != "" || d.Limit != 0 {
+		t.Errorf("Unexpected rule file fields, %+v", d)
+	}
+}
+
+func TestLoadNestedDirectory(t *testing.T) {
+	rules, err := LoadConfigurationDirectory("testdata3", "namespace", "prom")
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	var seen []string
+	for _, rule := range rules.Items {
+		seen = append(seen, rule.GetName())
+	}
+	expected := []string{"prom-team-app-rules", "prom-top-rules"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Saw %v, expected %v", seen, expected)
+	}
+
+	_, err = LoadConfigurationDirectory("testdata4", "namespace", "prom")
+	if err == nil {
+		t.Errorf("Expected an error for two files with the same rule name")
+	}
+}
+
 func TestLoadConfigurationFile(t *testing.T) {
 	cases := []struct {
 		filename     string
@@ -84,3 +194,249 @@ func TestLoadConfigurationFile(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRuleSpec(t *testing.T) {
+	cases := []struct {
+		yaml         string
+		expectedFail bool
+		// Expected labels of the first rule in the first group
+		expectedLabels map[string]string
+	}{
+		{"groups:\n- name: a\n  rules:\n  - record: b\n    expr: up\n", false, nil},
+		{"groups:\n- name: a\n  labels:\n    team: x\n  rules:\n  - record: b\n    expr: up\n", false, map[string]string{"team": "x"}},
+		{"groups:\n- name: a\n  labels:\n    team: x\n    env: y\n  rules:\n  - record: b\n    expr: up\n    labels:\n      team: z\n", false, map[string]string{"team": "z", "env": "y"}},
+		{"groups:\n- name: a\n  limit: 5\n  rules:\n  - record: b\n    expr: up\n", true, nil},
+		{"groups:\n- name: a\n  query_offset: 1m\n  rules:\n  - record: b\n    expr: up\n", true, nil},
+		{"groups:\n- name: a\n  rules:\n  - alert: b\n    expr: up == 0\n    keep_firing_for: 5m\n", true, nil},
+		{"groups:\n- name: a\n  partial_response_strategy: warn\n  rules:\n  - record: b\n    expr: up\n", true, nil},
+	}
+
+	for ix, td := range cases {
+		seen, err := ParseRuleSpec([]byte(td.yaml))
+		if (err != nil) != td.expectedFail {
+			t.Errorf("Case #%d, unexpected error status, (err != nil) is %v, expected %v (%v)", ix, err != nil, td.expectedFail, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		rule := seen.Groups[0].Rules[0]
+		if rule.Expr.String() != "up" {
+			t.Errorf("Case #%d, saw expr %q, expected %q", ix, rule.Expr.String(), "up")
+		}
+		if !reflect.DeepEqual(rule.Labels, td.expectedLabels) {
+			t.Errorf("Case #%d, saw labels %v, expected %v", ix, rule.Labels, td.expectedLabels)
+		}
+	}
+}
+
+func TestParseRuleSpecLintIgnore(t *testing.T) {
+	data := []byte("groups:\n- name: a\n  rules:\n  - alert: b\n    expr: up == 0\n    annotations:\n      summary: down\n      lint_ignore: paging_for\n  - alert: c\n    expr: up == 0\n    annotations:\n      lint_ignore: paging_for\n")
+	seen, err := ParseRuleSpec(data)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	rules := seen.Groups[0].Rules
+	if !reflect.DeepEqual(rules[0].Annotations, map[string]string{"summary": "down"}) {
+		t.Errorf("Saw annotations %v, expected only summary", rules[0].Annotations)
+	}
+	if rules[1].Annotations != nil {
+		t.Errorf("Saw annotations %v, expected none", rules[1].Annotations)
+	}
+}
+
+func TestParseRuleSpecStrict(t *testing.T) {
+	data := []byte("groups:\n- name: a\n  rules:\n  - alert: b\n    expr: up == 0\n    anotations:\n      summary: down\n")
+
+	if _, err := ParseRuleSpec(data); err == nil {
+		t.Errorf("Expected unknown field to fail in strict mode")
+	}
+
+	l := &Loader{}
+	if _, _, err := l.parseRuleSpec("rules.yaml", data); err != nil {
+		t.Errorf("Unexpected error in non-strict mode, %s", err)
+	}
+}
+
+func TestSplitPartName(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+		part     int
+	}{
+		{"prom-a-rules", "prom-a-rules", 0},
+		{"prom-a-rules-part-1", "prom-a-rules", 1},
+		{"prom-a-rules-part-12", "prom-a-rules", 12},
+		{"prom-a-rules-part-0", "prom-a-rules-part-0", 0},
+		{"prom-a-rules-part-", "prom-a-rules-part-", 0},
+	}
+
+	for ix, td := range cases {
+		seen, part := SplitPartName(td.name)
+		if seen != td.expected || part != td.part {
+			t.Errorf("Case #%d, saw %s, %d, expected %s, %d", ix, seen, part, td.expected, td.part)
+		}
+		if part > 0 && PartName(seen, part) != td.name {
+			t.Errorf("Case #%d, PartName does not undo SplitPartName, saw %s", ix, PartName(seen, part))
+		}
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	group := func(name string) v1.RuleGroup {
+		return v1.RuleGroup{Name: name, Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString(strings.Repeat("1+", 100) + "1")}}}
+	}
+	rule := &v1.PrometheusRule{Spec: v1.PrometheusRuleSpec{Groups: []v1.RuleGroup{group("a"), group("b"), group("c")}}}
+	rule.SetName("prom-big-rules")
+	rule.SetLabels(ruleLabels("prom"))
+
+	size, err := ObjectSize(rule)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	one := &v1.PrometheusRule{Spec: v1.PrometheusRuleSpec{Groups: []v1.RuleGroup{group("a")}}}
+	one.SetName("prom-big-rules-part-1")
+	one.SetLabels(ruleLabels("prom"))
+	oneSize, _ := ObjectSize(one)
+
+	cases := []struct {
+		max      int
+		split    bool
+		expected []string
+	}{
+		{size, false, []string{"prom-big-rules"}},
+		{size - 1, false, nil},
+		{size - 1, true, []string{"prom-big-rules-part-1", "prom-big-rules-part-2"}},
+		{oneSize, true, []string{"prom-big-rules-part-1", "prom-big-rules-part-2", "prom-big-rules-part-3"}},
+		{oneSize - 1, true, nil},
+	}
+
+	for ix, td := range cases {
+		l := &Loader{MaxObjectSize: td.max, SplitOversized: td.split}
+		parts, err := l.checkSize("big.yaml", rule)
+		if (err != nil) != (td.expected == nil) {
+			t.Errorf("Case #%d, unexpected error status, %v", ix, err)
+			continue
+		}
+		var seen []string
+		var groups []v1.RuleGroup
+		for _, part := range parts {
+			seen = append(seen, part.GetName())
+			groups = append(groups, part.Spec.Groups...)
+			if part.GetLabels()["prometheus"] != "prom" {
+				t.Errorf("Case #%d, %s lost its labels", ix, part.GetName())
+			}
+		}
+		if !reflect.DeepEqual(seen, td.expected) {
+			t.Errorf("Case #%d, saw %v, expected %v", ix, seen, td.expected)
+		}
+		if err == nil && !reflect.DeepEqual(groups, rule.Spec.Groups) {
+			t.Errorf("Case #%d, groups changed by splitting, saw %v", ix, groups)
+		}
+	}
+	if len(rule.Spec.Groups) != 3 || rule.GetName() != "prom-big-rules" {
+		t.Errorf("Splitting modified the original rule, %v", rule)
+	}
+
+	l := &Loader{MaxObjectSize: size - 1}
+	_, err = l.checkSize("big.yaml", rule)
+	if err == nil || !strings.Contains(err.Error(), "big.yaml: PrometheusRule prom-big-rules would be") {
+		t.Errorf("Unexpected error for an oversized rule, %v", err)
+	}
+
+	// Fits, but not once annotations are added after loading
+	annotated := rule.DeepCopy()
+	annotated.SetAnnotations(map[string]string{"example.com/commit": "abc123"})
+	annotatedSize, _ := ObjectSize(annotated)
+	l = &Loader{MaxObjectSize: size, Reserve: annotatedSize - size}
+	if _, err := l.checkSize("big.yaml", rule); err == nil {
+		t.Errorf("Expected an error for a rule too large once annotated")
+	}
+	l.MaxObjectSize = annotatedSize
+	if _, err := l.checkSize("big.yaml", rule); err != nil {
+		t.Errorf("Unexpected error for a rule that fits once annotated, %s", err)
+	}
+}
+
+func TestLoaderNaming(t *testing.T) {
+	cases := []struct {
+		loader   Loader
+		expected map[string]string
+		fail     bool
+	}{
+		{Loader{Prometheus: "prom"}, map[string]string{"prom-team-app-rules": "", "prom-top-rules": ""}, false},
+		{Loader{Prometheus: "prom", NameTemplate: "{{ .Name }}.rules"}, map[string]string{"team-app.rules": "", "top.rules": ""}, false},
+		{
+			Loader{Prometheus: "prom", Labels: map[string]string{"team": "sre", "rule-file": "{{ .Name }}"}, Annotations: map[string]string{"example.com/source": "rules/{{ .File }}"}},
+			map[string]string{"prom-team-app-rules": "rules/team/app.yaml", "prom-top-rules": "rules/top.yaml"},
+			false,
+		},
+		// Not a DNS-1123 subdomain
+		{Loader{Prometheus: "prom", NameTemplate: "rules-{{ .File }}"}, nil, true},
+		// No text of our own
+		{Loader{Prometheus: "prom", NameTemplate: "{{ .Name }}"}, nil, true},
+		{Loader{Prometheus: "prom", NameTemplate: "{{ .Name }}-{{ .File }}."}, nil, true},
+		// Not unique
+		{Loader{Prometheus: "prom", NameTemplate: "{{ .Prometheus }}"}, nil, true},
+		{Loader{Prometheus: "prom", NameTemplate: "{{ .Missing }}"}, nil, true},
+		{Loader{Prometheus: "prom", NameTemplate: "{{ .Name "}, nil, true},
+		{Loader{Prometheus: "prom", Labels: map[string]string{"prometheus": "other"}}, nil, true},
+		{Loader{Prometheus: "prom", Labels: map[string]string{"bad key": "x"}}, nil, true},
+		// Not a valid label value
+		{Loader{Prometheus: "prom", Labels: map[string]string{"file": "{{ .File }}"}}, nil, true},
+		{Loader{Prometheus: "prom", Annotations: map[string]string{"bad key": "x"}}, nil, true},
+	}
+
+	for ix, td := range cases {
+		rules, err := td.loader.LoadDirectory("testdata3")
+		if (err != nil) != td.fail {
+			t.Errorf("Case #%d, unexpected error status, %v", ix, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		seen := make(map[string]string)
+		for _, rule := range rules.Items {
+			seen[rule.GetName()] = rule.GetAnnotations()["example.com/source"]
+			if rule.GetLabels()["prometheus"] != "prom" || rule.GetLabels()["role"] != "prometheus-rulefiles" {
+				t.Errorf("Case #%d, %s is missing the prometheus labels, %v", ix, rule.GetName(), rule.GetLabels())
+			}
+			for key, val := range td.loader.Labels {
+				if _, ok := rule.GetLabels()[key]; !ok {
+					t.Errorf("Case #%d, %s is missing label %s=%s", ix, rule.GetName(), key, val)
+				}
+			}
+		}
+		if !reflect.DeepEqual(seen, td.expected) {
+			t.Errorf("Case #%d, saw %v, expected %v", ix, seen, td.expected)
+		}
+	}
+}
+
+func TestLoaderIsRuleName(t *testing.T) {
+	cases := []struct {
+		template string
+		name     string
+		expected bool
+	}{
+		{"", "prom-a-rules", true},
+		{"", "prom-team-a-rules-part-2", true},
+		{"", "prom-rules", false},
+		{"", "other-a-rules", false},
+		{"", "prom-a-rules-x", false},
+		{"rules-{{ .Prometheus }}.{{ .Name }}", "rules-prom.a", true},
+		{"rules-{{ .Prometheus }}.{{ .Name }}", "rules-promxa", false},
+		{"{{ .Name }}.rules", "a.rules", true},
+		{"{{ .Name }}.rules", "alertmanager", false},
+		{"{{ .Name }}", "anything", false},
+		{"{{ .Name ", "prom-a-rules", false},
+	}
+
+	for ix, td := range cases {
+		l := &Loader{Prometheus: "prom", NameTemplate: td.template}
+		if seen := l.IsRuleName(td.name); seen != td.expected {
+			t.Errorf("Case #%d, IsRuleName(%q) is %v, expected %v", ix, td.name, seen, td.expected)
+		}
+	}
+}
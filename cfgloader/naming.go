@@ -0,0 +1,213 @@
+package cfgloader
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultNameTemplate is the template PrometheusRules are named by,
+// unless a Loader has another.
+const DefaultNameTemplate = "{{ .Prometheus }}-{{ .Name }}-rules"
+
+// NameData is what the name, label and annotation templates of a
+// Loader are expanded with, for each rule file.
+type NameData struct {
+	// Name of the prometheus the rules are for
+	Prometheus string
+	// Path of the rule file relative to the rules directory, without
+	// ".yaml", with slashes and dots replaced by dashes
+	Name string
+	// Path of the rule file relative to the rules directory, with
+	// forward slashes
+	File string
+}
+
+// naming holds the compiled templates of a Loader.
+type naming struct {
+	prometheus  string
+	name        *template.Template
+	labels      map[string]*template.Template
+	annotations map[string]*template.Template
+}
+
+// compile parses the templates of the loader, and checks that the
+// label and annotation keys are valid.
+func (l *Loader) compile() (*naming, error) {
+	text := l.NameTemplate
+	if text == "" {
+		text = DefaultNameTemplate
+	}
+	name, err := parseTemplate("name", text)
+	if err != nil {
+		return nil, err
+	}
+	rv := &naming{
+		prometheus:  l.Prometheus,
+		name:        name,
+		labels:      make(map[string]*template.Template),
+		annotations: make(map[string]*template.Template),
+	}
+
+	// Rules uploaded to a ruler or a ConfigMap can only be told apart
+	// from others by their name, so it needs some text of our own.
+	literals, err := rv.literals()
+	if err != nil {
+		return nil, err
+	}
+	if !ownText.MatchString(strings.Join(literals, "")) {
+		return nil, fmt.Errorf("invalid name template %q: it needs text besides .Name and .File, such as .Prometheus, to tell our rules from others", text)
+	}
+
+	reserved := ruleLabels(l.Prometheus)
+	for key, text := range l.Labels {
+		if _, ok := reserved[key]; ok {
+			return nil, fmt.Errorf("label %s can not be changed, it selects the rules for the prometheus", key)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label %s: %s", key, strings.Join(errs, ", "))
+		}
+		if rv.labels[key], err = parseTemplate("label "+key, text); err != nil {
+			return nil, err
+		}
+	}
+	for key, text := range l.Annotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid annotation %s: %s", key, strings.Join(errs, ", "))
+		}
+		if rv.annotations[key], err = parseTemplate("annotation "+key, text); err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// parseTemplate parses one of the templates of a Loader.
+func parseTemplate(what, text string) (*template.Template, error) {
+	rv, err := template.New(what).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %s", what, err)
+	}
+	return rv, nil
+}
+
+// data returns the template data for the rule file at the path rel,
+// relative to the rules directory.
+func (n *naming) data(rel string) NameData {
+	return NameData{
+		Prometheus: n.prometheus,
+		Name:       fileBaseName(relativeFileName(rel)),
+		File:       filepath.ToSlash(rel),
+	}
+}
+
+// ruleName returns the name of the PrometheusRule for a rule file,
+// checking that it is valid.
+func (n *naming) ruleName(data NameData) (string, error) {
+	rv, err := expand(n.name, data)
+	if err != nil {
+		return "", err
+	}
+	return rv, validateName(rv)
+}
+
+// decorate adds the extra labels and annotations to a PrometheusRule.
+func (n *naming) decorate(rule *v1.PrometheusRule, data NameData) error {
+	labels := rule.GetLabels()
+	for _, key := range sortedTemplateKeys(n.labels) {
+		val, err := expand(n.labels[key], data)
+		if err != nil {
+			return err
+		}
+		if errs := validation.IsValidLabelValue(val); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q for label %s: %s", val, key, strings.Join(errs, ", "))
+		}
+		labels[key] = val
+	}
+	rule.SetLabels(labels)
+
+	if len(n.annotations) > 0 {
+		annotations := rule.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		for _, key := range sortedTemplateKeys(n.annotations) {
+			val, err := expand(n.annotations[key], data)
+			if err != nil {
+				return err
+			}
+			annotations[key] = val
+		}
+		rule.SetAnnotations(annotations)
+	}
+	return nil
+}
+
+// expand expands a template with data.
+func expand(tpl *template.Template, data NameData) (string, error) {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to expand %s template: %s", tpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// validateName checks that name is a valid PrometheusRule name.
+func validateName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid PrometheusRule name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// sortedTemplateKeys returns the keys of m, sorted.
+func sortedTemplateKeys(m map[string]*template.Template) []string {
+	var rv []string
+	for key := range m {
+		rv = append(rv, key)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// ownText matches the text a name template needs besides what it takes
+// from the rule file.
+var ownText = regexp.MustCompile("[A-Za-z0-9]")
+
+// literals returns the text of the names the template gives, split
+// where it takes parts from the rule file.
+func (n *naming) literals() ([]string, error) {
+	const marker = "\x00"
+	pattern, err := expand(n.name, NameData{Prometheus: n.prometheus, Name: marker, File: marker})
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(pattern, marker), nil
+}
+
+// IsRuleName reports whether name is what the loader could name the
+// rules from a file, or a part of them. Anything the name template
+// takes from the rule file can match any text.
+func (l *Loader) IsRuleName(name string) bool {
+	n, err := l.compile()
+	if err != nil {
+		return false
+	}
+	literals, err := n.literals()
+	if err != nil {
+		return false
+	}
+	var quoted []string
+	for _, literal := range literals {
+		quoted = append(quoted, regexp.QuoteMeta(literal))
+	}
+	name, _ = SplitPartName(name)
+	return regexp.MustCompile("^" + strings.Join(quoted, ".+") + "$").MatchString(name)
+}
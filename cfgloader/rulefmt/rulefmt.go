@@ -1,21 +1,30 @@
 // This is a hack to get around "pulling prometheus takes forever"
 package rulefmt
 
+// RuleGroups is the top level of a prometheus rule file.
 type RuleGroups struct {
 	Groups []RuleGroup `yaml:"groups"`
 }
 
+// RuleGroup is a named list of rules, evaluated together.
 type RuleGroup struct {
-	Name     string `yaml:"name"`
-	Interval string `yaml:"interval,omitempty"`
-	Rules    []Rule `yaml:"rules"`
+	Name        string `yaml:"name"`
+	Interval    string `yaml:"interval,omitempty"`
+	QueryOffset string `yaml:"query_offset,omitempty"`
+	Limit       int    `yaml:"limit,omitempty"`
+	// Only understood by Thanos
+	PartialResponseStrategy string            `yaml:"partial_response_strategy,omitempty"`
+	Rules                   []Rule            `yaml:"rules"`
+	Labels                  map[string]string `yaml:"labels,omitempty"`
 }
 
+// Rule is a single alerting or recording rule.
 type Rule struct {
-	Record      string            `yaml:"record,omitempty"`
-	Alert       string            `yaml:"alert,omitempty"`
-	Expr        string            `yaml:expr`
-	For         string            `yaml:"for,omitempty"`
-	Labels      map[string]string `yaml:"labels,omitempty"`
-	Annotations map[string]string `yaml:"annotations,omitempty"`
+	Record        string            `yaml:"record,omitempty"`
+	Alert         string            `yaml:"alert,omitempty"`
+	Expr          string            `yaml:"expr"`
+	For           string            `yaml:"for,omitempty"`
+	KeepFiringFor string            `yaml:"keep_firing_for,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty"`
+	Annotations   map[string]string `yaml:"annotations,omitempty"`
 }
@@ -0,0 +1,85 @@
+package rulefmt
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const fullRuleFile = `
+groups:
+  - name: full
+    interval: 30s
+    query_offset: 1m
+    limit: 10
+    partial_response_strategy: warn
+    labels:
+      team: storage
+    rules:
+      - record: job:up:sum
+        expr: sum(up) by (job)
+        labels:
+          level: job
+      - alert: JobDown
+        expr: job:up:sum == 0
+        for: 5m
+        keep_firing_for: 10m
+        labels:
+          severity: page
+        annotations:
+          summary: "{{ $labels.job }} is down"
+`
+
+func TestUnmarshalFullRuleFile(t *testing.T) {
+	expected := RuleGroups{Groups: []RuleGroup{
+		{
+			Name:                    "full",
+			Interval:                "30s",
+			QueryOffset:             "1m",
+			Limit:                   10,
+			PartialResponseStrategy: "warn",
+			Labels:                  map[string]string{"team": "storage"},
+			Rules: []Rule{
+				{
+					Record: "job:up:sum",
+					Expr:   "sum(up) by (job)",
+					Labels: map[string]string{"level": "job"},
+				},
+				{
+					Alert:         "JobDown",
+					Expr:          "job:up:sum == 0",
+					For:           "5m",
+					KeepFiringFor: "10m",
+					Labels:        map[string]string{"severity": "page"},
+					Annotations:   map[string]string{"summary": "{{ $labels.job }} is down"},
+				},
+			},
+		},
+	}}
+
+	var seen RuleGroups
+	if err := yaml.Unmarshal([]byte(fullRuleFile), &seen); err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Saw %#v\nexpected %#v", seen, expected)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	var first, second RuleGroups
+	if err := yaml.Unmarshal([]byte(fullRuleFile), &first); err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	data, err := yaml.Marshal(first)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if err := yaml.Unmarshal(data, &second); err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Round trip changed the rules, marshalled form was:\n%s", data)
+	}
+}
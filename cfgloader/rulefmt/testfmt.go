@@ -0,0 +1,55 @@
+package rulefmt
+
+// UnitTestFile is the top level of a promtool unit test file. It is
+// only used to validate the structure of test files, promtool does
+// the actual testing.
+type UnitTestFile struct {
+	RuleFiles          []string    `yaml:"rule_files"`
+	EvaluationInterval string      `yaml:"evaluation_interval,omitempty"`
+	GroupEvalOrder     []string    `yaml:"group_eval_order,omitempty"`
+	Tests              []TestGroup `yaml:"tests"`
+}
+
+// TestGroup is a set of input series, and the tests run against them.
+type TestGroup struct {
+	Name            string            `yaml:"name,omitempty"`
+	Interval        string            `yaml:"interval,omitempty"`
+	InputSeries     []Series          `yaml:"input_series"`
+	AlertRuleTests  []AlertTestCase   `yaml:"alert_rule_test,omitempty"`
+	PromqlExprTests []PromqlTestCase  `yaml:"promql_expr_test,omitempty"`
+	ExternalLabels  map[string]string `yaml:"external_labels,omitempty"`
+	ExternalURL     string            `yaml:"external_url,omitempty"`
+}
+
+// Series is a single input series, in promtool's expanding notation.
+type Series struct {
+	Series string `yaml:"series"`
+	Values string `yaml:"values"`
+}
+
+// AlertTestCase lists the alerts expected to fire at a given time.
+type AlertTestCase struct {
+	EvalTime  string  `yaml:"eval_time"`
+	Alertname string  `yaml:"alertname"`
+	ExpAlerts []Alert `yaml:"exp_alerts"`
+}
+
+// Alert is a single expected alert.
+type Alert struct {
+	ExpLabels      map[string]string `yaml:"exp_labels"`
+	ExpAnnotations map[string]string `yaml:"exp_annotations"`
+}
+
+// PromqlTestCase lists the samples an expression is expected to
+// return at a given time.
+type PromqlTestCase struct {
+	Expr       string   `yaml:"expr"`
+	EvalTime   string   `yaml:"eval_time"`
+	ExpSamples []Sample `yaml:"exp_samples"`
+}
+
+// Sample is a single expected sample.
+type Sample struct {
+	Labels string  `yaml:"labels"`
+	Value  float64 `yaml:"value"`
+}
@@ -0,0 +1,111 @@
+package cfgloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+// MaxObjectSize is the largest, in bytes, a PrometheusRule may be once
+// serialized. The API server, or rather etcd behind it, refuses larger
+// objects.
+const MaxObjectSize = 1024 * 1024
+
+// partPattern matches the suffix PartName adds.
+var partPattern = regexp.MustCompile(`^(.+)-part-([1-9][0-9]*)$`)
+
+// PartName returns the name of part number part, starting at 1, of the
+// PrometheusRule name when it is split.
+func PartName(name string, part int) string {
+	return fmt.Sprintf("%s-part-%d", name, part)
+}
+
+// SplitPartName undoes PartName, returning the name of the unsplit
+// PrometheusRule and the part number, or the name itself and 0 if it
+// is not a part.
+func SplitPartName(name string) (string, int) {
+	m := partPattern.FindStringSubmatch(name)
+	if m == nil {
+		return name, 0
+	}
+	part, err := strconv.Atoi(m[2])
+	if err != nil {
+		return name, 0
+	}
+	return m[1], part
+}
+
+// ObjectSize returns the size of a PrometheusRule, serialized as JSON
+// the way it is sent to the API server.
+func ObjectSize(rule *v1.PrometheusRule) (int, error) {
+	manifest := *rule
+	manifest.APIVersion = v1.SchemeGroupVersion.String()
+	manifest.Kind = v1.PrometheusRuleKind
+	buf, err := json.Marshal(&manifest)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// maxObjectSize returns the size limit for PrometheusRules, less the
+// space reserved for annotations added later.
+func (l *Loader) maxObjectSize() int {
+	max := l.MaxObjectSize
+	if max == 0 {
+		max = MaxObjectSize
+	}
+	return max - l.Reserve
+}
+
+// checkSize returns the PrometheusRules to upload for a rule loaded
+// from the named file: the rule itself, if it is no larger than the
+// size limit, less Reserve. Otherwise, if SplitOversized is set, its
+// groups are spread, in order, over as few parts as will fit, named by
+// PartName. Groups are never split, so a single group that is too
+// large is an error.
+func (l *Loader) checkSize(name string, rule *v1.PrometheusRule) ([]*v1.PrometheusRule, error) {
+	max := l.maxObjectSize()
+	size, err := ObjectSize(rule)
+	if err != nil {
+		return nil, asLoadErrors(name, err)
+	}
+	if size <= max {
+		return []*v1.PrometheusRule{rule}, nil
+	}
+	if !l.SplitOversized {
+		return nil, asLoadErrors(name, fmt.Errorf("PrometheusRule %s would be %d bytes, more than the limit of %d, split the file into smaller ones, or split it automatically with --split-oversized", rule.GetName(), size, max))
+	}
+
+	var rv []*v1.PrometheusRule
+	var groups []v1.RuleGroup
+	for _, g := range rule.Spec.Groups {
+		if _, ok := makePart(rule, len(rv)+1, append(groups, g), max); ok {
+			groups = append(groups, g)
+			continue
+		}
+		if len(groups) > 0 {
+			part, _ := makePart(rule, len(rv)+1, groups, max)
+			rv = append(rv, part)
+		}
+		groups = []v1.RuleGroup{g}
+		if _, ok := makePart(rule, len(rv)+1, groups, max); !ok {
+			return nil, LoadErrors{{File: name, Group: g.Name, Rule: -1, Err: fmt.Errorf("group alone would make a PrometheusRule larger than the limit of %d", max)}}
+		}
+	}
+	part, _ := makePart(rule, len(rv)+1, groups, max)
+	return append(rv, part), nil
+}
+
+// makePart returns part number part of rule, holding groups, and
+// whether it fits in max bytes.
+func makePart(rule *v1.PrometheusRule, part int, groups []v1.RuleGroup, max int) (*v1.PrometheusRule, bool) {
+	rv := rule.DeepCopy()
+	rv.Spec.Groups = append([]v1.RuleGroup(nil), groups...)
+	rv.SetName(PartName(rule.GetName(), part))
+	size, err := ObjectSize(rv)
+	return rv, err == nil && size <= max
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	monitoringv1 "github.com/coreos/prometheus-operator/pkg/client/versioned"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fieldManager is the name the API server records as the owner of the
+// fields we set when applying PrometheusRules.
+const fieldManager = "prometheus-config-loader"
+
+// applyPatchType is the content type for server-side apply.
+const applyPatchType = types.PatchType("application/apply-patch+yaml")
+
+// applyRule creates or updates a PrometheusRule using server-side
+// apply, so fields set by other field managers are left alone. Fields
+// owned by another manager that we would change cause a conflict,
+// unless force is set, in which case we take ownership of them.
+//
+// API servers that do not support server-side apply get a Create,
+// followed by an Update if the rule already exists, see
+// createOrUpdateRule.
+func applyRule(out io.Writer, api monitoringv1.Interface, namespace string, rule *v1.PrometheusRule, force bool) error {
+	manifest := *rule
+	manifest.APIVersion = v1.SchemeGroupVersion.String()
+	manifest.Kind = v1.PrometheusRuleKind
+	manifest.SetNamespace(namespace)
+	manifest.SetResourceVersion("")
+	buf, err := json.Marshal(&manifest)
+	if err != nil {
+		return fmt.Errorf("marshalling %s failed: %s", rule.GetName(), err)
+	}
+
+	req := api.MonitoringV1().RESTClient().Patch(applyPatchType).
+		Namespace(namespace).
+		Resource(v1.PrometheusRuleName).
+		Name(rule.GetName()).
+		Param("fieldManager", fieldManager)
+	if force {
+		req = req.Param("force", "true")
+	}
+	err = req.Body(buf).Do().Error()
+	if apierrors.IsUnsupportedMediaType(err) {
+		return createOrUpdateRule(out, api, namespace, rule)
+	}
+	return classifyApplyError(rule.GetName(), err)
+}
+
+// createOrUpdateRule creates a PrometheusRule, replacing the existing
+// one if there is one. Unlike server-side apply, replacing it
+// overwrites fields set by other field managers, so it is logged.
+func createOrUpdateRule(out io.Writer, api monitoringv1.Interface, namespace string, rule *v1.PrometheusRule) error {
+	client := api.MonitoringV1().PrometheusRules(namespace)
+	_, err := client.Create(rule)
+	if !apierrors.IsAlreadyExists(err) {
+		return classifyUpdateError(rule.GetName(), err)
+	}
+
+	log.Printf("WARNING: server-side apply is not supported, replacing %s in namespace %s, overwriting any fields set by others", rule.GetName(), namespace)
+	p, err := client.Get(rule.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s when trying to update: %s", rule.GetName(), err)
+	}
+	rule.SetResourceVersion(p.GetResourceVersion())
+	_, err = client.Update(rule)
+	if err != nil && !apierrors.IsConflict(err) && !apierrors.IsForbidden(err) {
+		oldBuf, _ := json.MarshalIndent(p, "", "  ")
+		newBuf, _ := json.MarshalIndent(rule, "", "  ")
+		fmt.Fprintf(out, "Existing:\n%s\n\nNew:\n%s\n", string(oldBuf), string(newBuf))
+	}
+	return classifyUpdateError(rule.GetName(), err)
+}
+
+// classifyApplyError turns an error from a server-side apply into one
+// explaining what went wrong with the named object. A conflict here
+// means fields are owned by another field manager.
+func classifyApplyError(name string, err error) error {
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("conflict updating %s, fields are owned by another manager (use --force-conflicts to take them over): %s", name, err)
+	}
+	return classifyUpdateError(name, err)
+}
+
+// classifyUpdateError turns an error from a create or update into one
+// explaining what went wrong with the named object. A conflict here
+// means the object was changed since we read it.
+func classifyUpdateError(name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsConflict(err):
+		return fmt.Errorf("%s was changed by someone else while updating it, try again: %s", name, err)
+	case apierrors.IsForbidden(err):
+		return fmt.Errorf("not allowed to update %s: %s", name, err)
+	case apierrors.IsInvalid(err):
+		return fmt.Errorf("%s was rejected as invalid: %s", name, err)
+	}
+	return fmt.Errorf("failed to create or update %s, %s", name, err)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	clientapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// The formats rules can be uploaded, or written to the output
+// directory, in.
+const (
+	prometheusRuleFormat = "prometheusrule"
+	configMapFormat      = "configmap"
+	ruleFilesFormat      = "rulefiles"
+)
+
+// maxConfigMapSize is the most data the API server accepts in a single
+// ConfigMap.
+const maxConfigMapSize = 1024 * 1024
+
+// ruleFiles renders every PrometheusRule as a plain prometheus rule
+// file, keyed by file name.
+func ruleFiles(rules *v1.PrometheusRuleList) (map[string]string, error) {
+	rv := make(map[string]string)
+	for _, rule := range rules.Items {
+		data, err := renderRuleFile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s: %s", rule.GetName(), err)
+		}
+		rv[ruleFileName(rule.GetName())] = data
+	}
+	return rv, nil
+}
+
+// ruleFileName is the name of the rule file holding a rule.
+func ruleFileName(name string) string {
+	return name + ".yaml"
+}
+
+// configMapName is the name of the ConfigMap holding the rules for a
+// target.
+func configMapName(name string, target ruleTarget) string {
+	if name != "" {
+		return name
+	}
+	return target.Prometheus + "-rule-files"
+}
+
+// checkConfigMapSize returns an error if the data would not fit in a
+// single ConfigMap.
+func checkConfigMapSize(name string, data map[string]string) error {
+	size := 0
+	for key, val := range data {
+		size += len(key) + len(val)
+	}
+	if size > maxConfigMapSize {
+		return fmt.Errorf("ConfigMap %s would hold %d bytes of rules, more than the limit of %d", name, size, maxConfigMapSize)
+	}
+	return nil
+}
+
+// ownersAnnotation records, as JSON, which prometheus every rule in a
+// ConfigMap was written for, so that prune only deletes our own.
+const ownersAnnotation = "prometheus-config-loader/owners"
+
+// configMapOwners returns which prometheus every rule in a ConfigMap
+// was written for, by rule name.
+func configMapOwners(cm *corev1.ConfigMap) (map[string]string, error) {
+	rv := make(map[string]string)
+	if text, ok := cm.GetAnnotations()[ownersAnnotation]; ok {
+		if err := json.Unmarshal([]byte(text), &rv); err != nil {
+			return nil, fmt.Errorf("failed to parse the %s annotation of ConfigMap %s: %s", ownersAnnotation, cm.GetName(), err)
+		}
+	}
+	return rv, nil
+}
+
+// newConfigMap returns a ConfigMap manifest holding data.
+func newConfigMap(name, namespace string, data map[string]string) *corev1.ConfigMap {
+	rv := &corev1.ConfigMap{Data: data}
+	rv.APIVersion = "v1"
+	rv.Kind = "ConfigMap"
+	rv.SetName(name)
+	rv.SetNamespace(namespace)
+	return rv
+}
+
+// newCoreClient creates a client for the core kubernetes API for the
+// named context.
+func newCoreClient(c *clientapi.Config, context string) (corev1client.CoreV1Interface, error) {
+	cc, err := restConfig(c, context)
+	if err != nil {
+		return nil, err
+	}
+	api, err := corev1client.NewForConfig(cc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to API server for context %s: %s", context, err)
+	}
+	return api, nil
+}
+
+// configMapSink stores every rule as a rule file, in a single
+// ConfigMap, for prometheus without prometheus-operator.
+type configMapSink struct {
+	configMaps corev1client.ConfigMapInterface
+	name       string
+	namespace  string
+	prometheus string
+}
+
+func (s *configMapSink) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s", s.namespace, s.name)
+}
+
+// get returns the ConfigMap, or nil if it does not exist.
+func (s *configMapSink) get() (*corev1.ConfigMap, error) {
+	rv, err := s.configMaps.Get(s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return rv, err
+}
+
+func (s *configMapSink) Existing(name string) (string, bool, error) {
+	cm, err := s.get()
+	if err != nil || cm == nil {
+		return "", false, err
+	}
+	rv, ok := cm.Data[ruleFileName(name)]
+	return rv, ok, nil
+}
+
+func (s *configMapSink) Render(rule *v1.PrometheusRule) (string, error) {
+	return renderRuleFile(rule)
+}
+
+func (s *configMapSink) Apply(out io.Writer, rule *v1.PrometheusRule) error {
+	data, err := s.Render(rule)
+	if err != nil {
+		return err
+	}
+	return s.update(func(files, owners map[string]string) {
+		files[ruleFileName(rule.GetName())] = data
+		owners[rule.GetName()] = s.prometheus
+	})
+}
+
+// List returns the rules in the ConfigMap recorded as written for our
+// prometheus.
+func (s *configMapSink) List() ([]string, error) {
+	cm, err := s.get()
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	owners, err := configMapOwners(cm)
+	if err != nil {
+		return nil, err
+	}
+	var rv []string
+	for name, prometheus := range owners {
+		if prometheus == s.prometheus {
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+func (s *configMapSink) Delete(name string) error {
+	return s.update(func(files, owners map[string]string) {
+		delete(files, ruleFileName(name))
+		delete(owners, name)
+	})
+}
+
+// ApplyAll replaces the rule files for our prometheus in the ConfigMap
+// with rules, in a single update, so the size limit applies to the end
+// result. Without prune, rule files that are no longer wanted are
+// kept.
+func (s *configMapSink) ApplyAll(out io.Writer, rules *v1.PrometheusRuleList, prune bool) error {
+	wanted, err := ruleFiles(rules)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	if prune {
+		stale, err = staleRules(s, rules)
+		if err != nil {
+			return err
+		}
+	}
+	return s.update(func(files, owners map[string]string) {
+		for _, name := range stale {
+			delete(files, ruleFileName(name))
+			delete(owners, name)
+		}
+		for key, val := range wanted {
+			files[key] = val
+		}
+		for _, rule := range rules.Items {
+			owners[rule.GetName()] = s.prometheus
+		}
+	})
+}
+
+// update changes the data in the ConfigMap, and the record of which
+// prometheus each rule is for, creating the ConfigMap if needed.
+func (s *configMapSink) update(change func(files, owners map[string]string)) error {
+	cm, err := s.get()
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %s", s, err)
+	}
+	create := cm == nil
+	if create {
+		cm = newConfigMap(s.name, s.namespace, nil)
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	owners, err := configMapOwners(cm)
+	if err != nil {
+		return err
+	}
+	change(cm.Data, owners)
+	buf, err := json.Marshal(owners)
+	if err != nil {
+		return err
+	}
+	annotations := cm.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[ownersAnnotation] = string(buf)
+	cm.SetAnnotations(annotations)
+
+	if err := checkConfigMapSize(s.name, cm.Data); err != nil {
+		return err
+	}
+	if create {
+		_, err = s.configMaps.Create(cm)
+	} else {
+		_, err = s.configMaps.Update(cm)
+	}
+	return classifyUpdateError(s.name, err)
+}
+
+// reloadPrometheus asks the prometheus at url to reload its
+// configuration, including its rule files. It does not wait for, or
+// check, anything: prometheus reloads whatever files it sees right
+// now, see reload.
+func reloadPrometheus(url string) error {
+	resp, err := http.Post(strings.TrimSuffix(url, "/")+"/-/reload", "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to reload prometheus: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to reload prometheus: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/G-Research/prometheus-config-loader/diff"
+)
+
+// Number of context lines shown around each change.
+const diffContext = 3
+
+// Annotations maintained by other tooling, which should not show up as
+// differences.
+var ignoredAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// diffSummary collects the names of the PrometheusRules in each
+// category, for a single context.
+type diffSummary struct {
+	Created   []string
+	Updated   []string
+	Unchanged []string
+	Pruned    []string
+}
+
+// normaliseRule strips everything the API server maintains from a
+// PrometheusRule, leaving only what we actually set.
+func normaliseRule(rule *v1.PrometheusRule) *v1.PrometheusRule {
+	rv := &v1.PrometheusRule{Spec: rule.Spec}
+	rv.SetName(rule.GetName())
+	rv.SetNamespace(rule.GetNamespace())
+	rv.SetLabels(rule.GetLabels())
+
+	annotations := make(map[string]string)
+	for key, val := range rule.GetAnnotations() {
+		annotations[key] = val
+	}
+	for _, key := range append(volatileAnnotations, ignoredAnnotations...) {
+		delete(annotations, key)
+	}
+	if len(annotations) > 0 {
+		rv.SetAnnotations(annotations)
+	}
+
+	return rv
+}
+
+// renderRule renders a normalised PrometheusRule as YAML. A nil rule
+// renders as the empty string.
+func renderRule(rule *v1.PrometheusRule) (string, error) {
+	if rule == nil {
+		return "", nil
+	}
+	buf, err := yaml.Marshal(normaliseRule(rule))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// writeRuleDiff writes a unified diff between the existing and the new
+// version of a rule, as rendered by the sink, either of which may be
+// empty. It returns true if there were any differences.
+func writeRuleDiff(out io.Writer, context, name, existing, generated string) bool {
+	d := diff.Unified(fmt.Sprintf("%s/%s (cluster)", context, name), fmt.Sprintf("%s/%s (generated)", context, name), existing, generated, diffContext)
+	if d == "" {
+		return false
+	}
+	fmt.Fprint(out, d)
+	return true
+}
+
+// diffPrometheusRules compares the loaded rules with what currently
+// exists in the sink, writing a diff per changed rule to out. If prune
+// is set, rules that would be pruned are included as deletions.
+func diffPrometheusRules(out io.Writer, s sink, rules *v1.PrometheusRuleList, context string, prune bool) (diffSummary, error) {
+	var rv diffSummary
+
+	for _, rule := range rules.Items {
+		existing, exists, err := s.Existing(rule.GetName())
+		if err != nil {
+			return rv, fmt.Errorf("failed to get %s in context %s: %s", rule.GetName(), context, err)
+		}
+		generated, err := s.Render(rule)
+		if err != nil {
+			return rv, err
+		}
+
+		changed := writeRuleDiff(out, context, rule.GetName(), existing, generated)
+		switch {
+		case !exists:
+			rv.Created = append(rv.Created, rule.GetName())
+		case changed:
+			rv.Updated = append(rv.Updated, rule.GetName())
+		default:
+			rv.Unchanged = append(rv.Unchanged, rule.GetName())
+		}
+	}
+
+	if !prune {
+		return rv, nil
+	}
+
+	stale, err := staleRules(s, rules)
+	if err != nil {
+		return rv, fmt.Errorf("failed to list existing rules in context %s: %s", context, err)
+	}
+	for _, name := range stale {
+		existing, _, err := s.Existing(name)
+		if err != nil {
+			return rv, fmt.Errorf("failed to get %s in context %s: %s", name, context, err)
+		}
+		writeRuleDiff(out, context, name, existing, "")
+		rv.Pruned = append(rv.Pruned, name)
+	}
+
+	return rv, nil
+}
+
+// Write a human-readable summary of a diff.
+func (d diffSummary) write(out io.Writer, context string) {
+	fmt.Fprintf(out, "Context %s: %d created, %d updated, %d unchanged, %d pruned\n", context, len(d.Created), len(d.Updated), len(d.Unchanged), len(d.Pruned))
+	for _, category := range []struct {
+		name  string
+		names []string
+	}{
+		{"created", d.Created},
+		{"updated", d.Updated},
+		{"unchanged", d.Unchanged},
+		{"pruned", d.Pruned},
+	} {
+		if len(category.names) > 0 {
+			fmt.Fprintf(out, "  %s: %s\n", category.name, strings.Join(category.names, ", "))
+		}
+	}
+}
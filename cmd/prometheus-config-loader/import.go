@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	monitoringv1 "github.com/coreos/prometheus-operator/pkg/client/versioned"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader"
+	"github.com/G-Research/prometheus-config-loader/importer"
+)
+
+// importFileName works out which rule file a PrometheusRule came from,
+// undoing what cfgloader does when naming it, or splitting it into
+// parts. Rules that were not created by us keep their name.
+func importFileName(name, prometheus string) string {
+	l := &cfgloader.Loader{Prometheus: prometheus}
+	if prometheus != "" && l.IsRuleName(name) {
+		name, _ = cfgloader.SplitPartName(name)
+		return strings.TrimSuffix(strings.TrimPrefix(name, prometheus+"-"), "-rules")
+	}
+	return name
+}
+
+// readSource reads all PrometheusRules in a namespace, limited to those
+// for the named prometheus if it is not empty. It also returns how many
+// PrometheusRules were read, as split rule files are joined back into
+// a single file.
+func readSource(api monitoringv1.Interface, namespace, prometheus string) (importer.Source, int, error) {
+	opts := metav1.ListOptions{}
+	if prometheus != "" {
+		opts.LabelSelector = cfgloader.RuleSelector(prometheus)
+	}
+	rules, err := api.MonitoringV1().PrometheusRules(namespace).List(opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The parts of a split rule file are joined back together, in
+	// order.
+	sort.Slice(rules.Items, func(i, j int) bool {
+		a, aPart := cfgloader.SplitPartName(rules.Items[i].GetName())
+		b, bPart := cfgloader.SplitPartName(rules.Items[j].GetName())
+		if a != b {
+			return a < b
+		}
+		return aPart < bPart
+	})
+	rv := make(importer.Source)
+	for _, rule := range rules.Items {
+		file := importFileName(rule.GetName(), prometheus)
+		groups := rv[file]
+		groups.Groups = append(groups.Groups, cfgloader.RuleGroupsFromSpec(rule.Spec).Groups...)
+		rv[file] = groups
+	}
+	return rv, len(rules.Items), nil
+}
+
+// runImport implements the import command, which reads the
+// PrometheusRules from one or more contexts and writes them to a new
+// source directory.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	kubeflag := fs.String("kubeconfig", "", "Kubernetes configuration file.")
+	flagContexts := fs.String("contexts", "", "Comma-separated list of contexts to import rules from.")
+	prometheus := fs.String("prometheus", "", "Only import PrometheusRules for this prometheus, as created by prometheus-config-loader.")
+	namespace := fs.String("namespace", "", "The namespace to import PrometheusRule objects from.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import <flags>... <output directory>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	outDir := fs.Arg(0)
+
+	var contexts []string
+	for _, context := range strings.Split(*flagContexts, ",") {
+		if context != "" {
+			contexts = append(contexts, context)
+		}
+	}
+	if len(contexts) == 0 {
+		log.Fatalf("No contexts specified.")
+	}
+
+	cfg := loadKubeConfig(kubeConfigFile(*kubeflag))
+	if !validateContexts(cfg, contexts) {
+		log.Fatalf("Contexts specified that do not exist in the configuration.")
+	}
+
+	sources := make(map[string]importer.Source)
+	for _, context := range contexts {
+		api, err := newMonitoringClient(cfg, context)
+		if err != nil {
+			log.Fatalf("Failed to import from context %s, %s", context, err)
+		}
+		source, count, err := readSource(api, *namespace, *prometheus)
+		if err != nil {
+			log.Fatalf("Failed to list rules in context %s, %s", context, err)
+		}
+		log.Printf("Read %d PrometheusRules, %d rule files, from context %s", count, len(source), context)
+		sources[context] = source
+	}
+
+	result, err := importer.Factor(contexts, sources)
+	if err != nil {
+		log.Fatalf("Failed to factor imported rules, %s", err)
+	}
+	for _, warning := range result.Warnings {
+		log.Printf("WARNING: %s", warning)
+	}
+	written, err := result.Write(outDir)
+	if err != nil {
+		log.Fatalf("Failed to write %s, %s", outDir, err)
+	}
+	log.Printf("Wrote %s to %s", strings.Join(written, ", "), outDir)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/client-go/rest"
+	clientapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Where the service account credentials are mounted in every pod.
+var (
+	serviceAccountTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// loadInClusterConfig builds a kubernetes configuration for the cluster
+// we are running in, using the pod's service account. It has a single
+// context, with the given name, whose namespace is the given one or,
+// if that is empty, that of the service account.
+func loadInClusterConfig(context, namespace string) (*clientapi.Config, error) {
+	rc, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		buf, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %s", err)
+		}
+		namespace = strings.TrimSpace(string(buf))
+	}
+	return inClusterKubeConfig(context, rc.Host, rc.TLSClientConfig.CAFile, namespace), nil
+}
+
+// inClusterKubeConfig returns a kubernetes configuration with a single
+// context, authenticating with the service account token.
+func inClusterKubeConfig(context, host, caFile, namespace string) *clientapi.Config {
+	cluster := clientapi.NewCluster()
+	cluster.Server = host
+	cluster.CertificateAuthority = caFile
+
+	auth := clientapi.NewAuthInfo()
+	auth.TokenFile = serviceAccountTokenFile
+
+	ctx := clientapi.NewContext()
+	ctx.Cluster = context
+	ctx.AuthInfo = context
+	ctx.Namespace = namespace
+
+	rv := clientapi.NewConfig()
+	rv.Clusters[context] = cluster
+	rv.AuthInfos[context] = auth
+	rv.Contexts[context] = ctx
+	rv.CurrentContext = context
+	return rv
+}
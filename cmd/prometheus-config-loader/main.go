@@ -7,20 +7,26 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
 	monitoringv1 "github.com/coreos/prometheus-operator/pkg/client/versioned"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	clientapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/util/homedir"
 
 	"github.com/G-Research/prometheus-config-loader/cfgloader"
+	"github.com/G-Research/prometheus-config-loader/lint"
 	"github.com/G-Research/prometheus-config-loader/promtool"
 	"github.com/G-Research/prometheus-config-loader/templates"
 )
@@ -39,41 +45,142 @@ func loadKubeConfig(kubeconfig string) *clientapi.Config {
 	return rv
 }
 
-func doSyntaxChecks(prom *promtool.Promtool, tplData templates.ExpansionData) error {
-	for _, tpl := range tplData {
+// selectChecker picks the syntax checker to use. With "auto", promtool
+// is used if it was found, falling back to the native checker if not.
+func selectChecker(name string, prom *promtool.Promtool) (promtool.Checker, error) {
+	switch name {
+	case "promtool":
+		if prom == nil {
+			return nil, errors.New("promtool not found in path")
+		}
+		return prom, nil
+	case "native":
+		return promtool.NewNative(), nil
+	case "auto":
+		if prom == nil {
+			log.Printf("WARNING: promtool not found, falling back to the native syntax checker.")
+			return promtool.NewNative(), nil
+		}
+		return prom, nil
+	}
+	return nil, fmt.Errorf("unknown checker %q, expected one of auto, promtool or native", name)
+}
+
+// sortedContexts returns the expansions in tplData, ordered by
+// context name.
+func sortedContexts(tplData templates.ExpansionData) []templates.TemplateData {
+	var names []string
+	for name := range tplData {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rv := make([]templates.TemplateData, len(names))
+	for ix, name := range names {
+		rv[ix] = tplData[name]
+	}
+	return rv
+}
+
+// doSyntaxChecks checks every rule file, for every context, returning
+// the result for each file.
+func doSyntaxChecks(prom promtool.Checker, tplData templates.ExpansionData) []checkResult {
+	var rv []checkResult
+	for _, tpl := range sortedContexts(tplData) {
 		log.Printf("Syntax-checking context %s (dir %s)", tpl.Context, tpl.Directory)
 		for _, file := range tpl.Files {
-			if !strings.HasPrefix(file, "tests/") {
+			if !templates.IsTestFile(file) {
+				start := time.Now()
 				out, err := prom.Check(filepath.Join(tpl.Directory, file))
 				if err != nil {
-					log.Println("Syntax checking failed,")
-					fmt.Println(out)
-					return err
+					log.Printf("ERROR: syntax checking %s failed in context %s,\n%s", file, tpl.Context, err)
 				}
+				rv = append(rv, newCheckResult(syntaxPhase, tpl.Context, file, start, out, err))
 			}
 		}
 	}
-	return nil
+	return rv
 }
 
-func doUnitTests(prom *promtool.Promtool, tplData templates.ExpansionData) error {
-	for _, tpl := range tplData {
-		if tpl.Context != unitTestContextName {
+// doLint checks every rule file, for every context, against the lint
+// policy, returning the result for each file. Files with only warnings
+// pass.
+func doLint(policy *lint.Policy, tplData templates.ExpansionData) []checkResult {
+	var rv []checkResult
+	for _, tpl := range sortedContexts(tplData) {
+		log.Printf("Linting context %s (dir %s)", tpl.Context, tpl.Directory)
+		for _, file := range tpl.Files {
+			if templates.IsTestFile(file) {
+				continue
+			}
+			start := time.Now()
+			problems, err := lint.LintFile(policy, filepath.Join(tpl.Directory, file))
+			var out []string
+			for _, problem := range problems {
+				log.Printf("%s: context %s: %s", strings.ToUpper(string(problem.Level)), tpl.Context, problem)
+				out = append(out, fmt.Sprintf("%s: %s", problem.Level, problem))
+			}
+			if err == nil && problems.Errors() > 0 {
+				err = fmt.Errorf("%d lint errors", problems.Errors())
+			}
+			if err != nil {
+				log.Printf("ERROR: linting %s failed in context %s, %s", file, tpl.Context, err)
+			}
+			rv = append(rv, newCheckResult(lintPhase, tpl.Context, file, start, strings.Join(out, "\n"), err))
+		}
+	}
+	return rv
+}
+
+// doUnitTests runs every unit test file, for the unittest context or
+// for every context if allContexts is set, returning the result for
+// each file.
+func doUnitTests(prom *promtool.Promtool, tplData templates.ExpansionData, allContexts bool) []checkResult {
+	var rv []checkResult
+	for _, tpl := range sortedContexts(tplData) {
+		if tpl.Context != unitTestContextName && !allContexts {
 			continue
 		}
 		log.Printf("Unit-testing context %s (dir %s)", tpl.Context, tpl.Directory)
 		for _, file := range tpl.Files {
-			if strings.HasPrefix(file, "tests/") {
-				out, err := prom.Test(filepath.Join(tpl.Directory, file), tpl.Directory)
+			if templates.IsTestFile(file) {
+				// Rule files are named relative to the directory
+				// containing the tests directory.
+				workdir := filepath.Join(tpl.Directory, testBaseDir(file))
+				start := time.Now()
+				out, err := prom.Test(filepath.Join(tpl.Directory, file), workdir)
 				if err != nil {
-					log.Println("Syntax checking failed,")
-					fmt.Println(out)
-					return err
+					log.Printf("ERROR: unit test %s failed in context %s,\n%s", file, tpl.Context, err)
 				}
+				rv = append(rv, newCheckResult(unitTestPhase, tpl.Context, file, start, out, err))
 			}
 		}
 	}
-	return nil
+	return rv
+}
+
+// hasUnitTests reports whether doUnitTests would run any unit tests.
+func hasUnitTests(tplData templates.ExpansionData, allContexts bool) bool {
+	for _, tpl := range tplData {
+		if tpl.Context != unitTestContextName && !allContexts {
+			continue
+		}
+		for _, file := range tpl.Files {
+			if templates.IsTestFile(file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testBaseDir returns the directory containing the tests directory a
+// unit test file is in, relative to the top of the expansion.
+func testBaseDir(file string) string {
+	dir := filepath.Dir(file)
+	for filepath.Base(dir) != "tests" {
+		dir = filepath.Dir(dir)
+	}
+	return filepath.Dir(dir)
 }
 
 // Ensure all specified contexts are valid for the configuration
@@ -88,62 +195,231 @@ func validateContexts(cfg *clientapi.Config, contexts []string) bool {
 	return true
 }
 
-func uploadPrometheusRules(t templates.TemplateData, c *clientapi.Config, dryRun bool, prometheus string, namespace string) {
-	if t.Context == unitTestContextName {
-		return
+// newMonitoringClient creates a prometheus-operator API client for the
+// named context.
+func newMonitoringClient(c *clientapi.Config, context string) (monitoringv1.Interface, error) {
+	cc, err := restConfig(c, context)
+	if err != nil {
+		return nil, err
 	}
 
-	rules, err := cfgloader.LoadConfigurationDirectory(t.Directory, namespace, prometheus)
+	api, err := monitoringv1.NewForConfig(cc)
 	if err != nil {
-		log.Printf("ERROR: Failed to load prometheus rules from directory %s: %s", t.Directory, err)
-		return
-	}
-	if dryRun {
-		log.Printf("INFO: dry-run enabled, emitting loaded rules for context %s", t.Context)
-		buf, err := json.MarshalIndent(rules, "", "  ")
-		if err != nil {
-			log.Printf("ERROR: marshalling to JSON failed: %s", err)
-		} else {
-			fmt.Println(string(buf))
-		}
-		return
+		return nil, fmt.Errorf("failed to connect to API server for context %s: %s", context, err)
 	}
 
+	return api, nil
+}
+
+// restConfig returns the API client configuration for the named
+// context.
+func restConfig(c *clientapi.Config, context string) (*rest.Config, error) {
 	overrides := clientcmd.ConfigOverrides{
-		Context:        *(c.Contexts[t.Context]),
-		CurrentContext: t.Context,
+		Context:        *(c.Contexts[context]),
+		CurrentContext: context,
 	}
 
 	cc, err := clientcmd.NewDefaultClientConfig(*c, &overrides).ClientConfig()
 	if err != nil {
-		log.Printf("ERROR: failed to create API client configuration for context %s: %s", t.Context, err)
-		return
+		return nil, fmt.Errorf("failed to create API client configuration for context %s: %s", context, err)
 	}
+	return cc, nil
+}
 
-	api, err := monitoringv1.NewForConfig(cc)
+// staleRules returns the names of all rules in the sink that were
+// created for our prometheus, but are not part of the freshly loaded
+// rules.
+func staleRules(s sink, rules *v1.PrometheusRuleList) ([]string, error) {
+	wanted := make(map[string]bool)
+	for _, rule := range rules.Items {
+		wanted[rule.GetName()] = true
+	}
+
+	existing, err := s.List()
 	if err != nil {
-		log.Printf("ERROR: failed to connect to API server for context %s: %s", t.Context, err)
-		return
+		return nil, err
 	}
 
-	for _, rule := range rules.Items {
-		log.Printf("Uploading rule %s to namespace %s, in context %s", rule.GetName(), namespace, t.Context)
-		_, err := api.MonitoringV1().PrometheusRules(namespace).Create(rule)
+	var rv []string
+	for _, name := range existing {
+		if !wanted[name] {
+			rv = append(rv, name)
+		}
+	}
+	sort.Strings(rv)
+
+	return rv, nil
+}
+
+// pruneRules deletes all rules for our prometheus that no longer have
+// a corresponding rule file. If dryRun is set, the rules that would
+// have been deleted are only logged.
+func pruneRules(s sink, rules *v1.PrometheusRuleList, context string, dryRun bool) error {
+	stale, err := staleRules(s, rules)
+	if err != nil {
+		return fmt.Errorf("failed to list existing rules in context %s: %s", context, err)
+	}
+
+	for _, name := range stale {
+		if dryRun {
+			log.Printf("INFO: dry-run enabled, would delete rule %s from %s, in context %s", name, s, context)
+			continue
+		}
+		log.Printf("Deleting rule %s from %s, in context %s", name, s, context)
+		err := s.Delete(name)
 		if err != nil {
-			p, err := api.MonitoringV1().PrometheusRules(namespace).Get(rule.GetName(), metav1.GetOptions{})
-			if err != nil {
-				log.Fatalf("Failed to get %s when trying to update: %s", rule.GetName(), err)
+			return fmt.Errorf("failed to delete %s in context %s: %s", name, context, err)
+		}
+	}
+
+	return nil
+}
+
+// loadRules loads the expanded rules for every context, except the
+// unittest one. Problems loading any file, in any context, are all
+// returned, one error per problem. Fields the PrometheusRule CRD can
+// not represent are only allowed for contexts whose rules end up as
+// rule files.
+func loadRules(contexts []string, tplData templates.ExpansionData, opts uploadOptions) (map[string]*v1.PrometheusRuleList, []error) {
+	rv := make(map[string]*v1.PrometheusRuleList)
+	var errs []error
+	for _, context := range contexts {
+		if context == unitTestContextName {
+			continue
+		}
+		target := opts.targets[context]
+		l := target.loader()
+		l.RuleFiles = target.RulerURL != "" || opts.outputFormat == configMapFormat || opts.outputFormat == ruleFilesFormat
+		l.Strict = opts.strict
+		l.SplitOversized = opts.splitOversized
+		if !l.RuleFiles && opts.outputDir == "" {
+			// Uploaded PrometheusRules are annotated with their
+			// provenance, see crdSink.Apply.
+			l.Reserve = opts.provenance.size()
+		}
+		rules, err := l.LoadDirectory(tplData[context].Directory)
+		if loadErrs, ok := err.(cfgloader.LoadErrors); ok {
+			for _, loadErr := range loadErrs {
+				errs = append(errs, fmt.Errorf("context %s: %s", context, loadErr))
 			}
-			rule.SetResourceVersion(p.GetResourceVersion())
-			_, err = api.MonitoringV1().PrometheusRules(namespace).Update(rule)
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("context %s: %s", context, err))
+		}
+		rv[context] = rules
+	}
+	return rv, errs
+}
+
+// uploadPrometheusRules takes the loaded rules for a single context
+// and, depending on the options, writes them to a directory, prints
+// them, diffs them against the cluster or uploads them. Anything meant
+// for the user is written to out. It returns the number of
+// PrometheusRules loaded.
+func uploadPrometheusRules(out io.Writer, context string, rules *v1.PrometheusRuleList, c *clientapi.Config, opts uploadOptions) (int, error) {
+	if context == unitTestContextName {
+		return 0, nil
+	}
+
+	target := opts.targets[context]
+	if opts.outputDir != "" {
+		dir := filepath.Join(opts.outputDir, context)
+		var written []string
+		var err error
+		switch opts.outputFormat {
+		case configMapFormat:
+			written, err = writeConfigMapManifest(rules, dir, configMapName(opts.configMapName, target), target.Namespace)
+		case ruleFilesFormat:
+			written, err = writeRuleFiles(rules, dir)
+		default:
+			written, err = writeManifests(rules, dir)
+		}
+		if err != nil {
+			return len(rules.Items), fmt.Errorf("failed to write manifests to %s: %s", dir, err)
+		}
+		log.Printf("Wrote %d manifests for context %s to %s", len(written), context, dir)
+		// Manifests still have to be applied by someone else, only
+		// rule files are ready for prometheus to load.
+		if opts.outputFormat != ruleFilesFormat {
+			return len(rules.Items), nil
+		}
+		return len(rules.Items), reload(target, context, false)
+	}
+	if opts.dryRun && !opts.showDiff {
+		log.Printf("INFO: dry-run enabled, emitting loaded rules for context %s, %s", context, target)
+		buf, err := json.MarshalIndent(rules, "", "  ")
+		if err != nil {
+			return len(rules.Items), fmt.Errorf("marshalling to JSON failed: %s", err)
+		}
+		fmt.Fprintln(out, string(buf))
+		if !opts.prune {
+			return len(rules.Items), nil
+		}
+	}
+
+	s, err := newSink(c, context, target, opts)
+	if err != nil {
+		return len(rules.Items), err
+	}
+
+	if opts.showDiff {
+		log.Printf("INFO: diff enabled, comparing loaded rules with context %s, %s", context, s)
+		summary, err := diffPrometheusRules(out, s, rules, context, opts.prune)
+		if err != nil {
+			return len(rules.Items), err
+		}
+		summary.write(out, context)
+		return len(rules.Items), nil
+	}
+
+	if batch, ok := s.(batchSink); ok && !opts.dryRun {
+		log.Printf("Applying %d rules to %s, in context %s", len(rules.Items), s, context)
+		err := batch.ApplyAll(out, rules, opts.prune)
+		if err != nil {
+			return len(rules.Items), err
+		}
+		_, mounted := s.(*configMapSink)
+		return len(rules.Items), reload(target, context, mounted)
+	}
+
+	if !opts.dryRun {
+		for _, rule := range rules.Items {
+			log.Printf("Applying rule %s to %s, in context %s", rule.GetName(), s, context)
+			err := s.Apply(out, rule)
 			if err != nil {
-				oldBuf, _ := json.MarshalIndent(p, "", "  ")
-				newBuf, _ := json.MarshalIndent(rule, "", "  ")
-				fmt.Printf("Existing:\n%s\n\nNew:\n%s\n", string(oldBuf), string(newBuf))
-				log.Fatalf("Failed to create or update, %s", err)
+				return len(rules.Items), err
 			}
 		}
 	}
+
+	if opts.prune {
+		err = pruneRules(s, rules, context, opts.dryRun)
+		if err != nil {
+			return len(rules.Items), err
+		}
+	}
+	if opts.dryRun {
+		return len(rules.Items), nil
+	}
+
+	return len(rules.Items), reload(target, context, false)
+}
+
+// reload asks the prometheus of a target to reload its configuration,
+// if it has a prometheus URL. This is best-effort when the rules were
+// uploaded to a ConfigMap, as mounted: the kubelet only updates the
+// files in the pod some time after the ConfigMap changes, so the
+// reload most likely still sees the old rules. Such a prometheus needs
+// a sidecar reloading it when the files change, such as
+// prometheus-config-reloader, to reliably pick up the new rules.
+func reload(target ruleTarget, context string, mounted bool) error {
+	if target.PrometheusURL == "" {
+		return nil
+	}
+	if mounted {
+		log.Printf("WARNING: the ConfigMap may not be updated in the pod yet, without a config reloader sidecar prometheus %s, in context %s, may keep the old rules", target.PrometheusURL, context)
+	}
+	log.Printf("Reloading prometheus %s, in context %s", target.PrometheusURL, context)
+	return reloadPrometheus(target.PrometheusURL)
 }
 
 // Get the kubernetes config file based on environment variables,
@@ -166,75 +442,255 @@ func kubeConfigFile(flagval string) string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+
 	// TODO: It might be good to have a more intelligent "find the
 	// config file" function, but this is probably good enough for
 	// now.
-	kubeflag := flag.String("kubeconfig", "", "Kubernetes configuration file, set this to the empty string if the command is running inside a kubernetes pod.")
-	flagContexts := flag.String("contexts", "", "Comma-separated list of contexts to push configuration to.")
-	prometheus := flag.String("prometheus", "", "Name of the prometheus to push configuration for.")
-	namespace := flag.String("namespace", "", "The namespace we should create PrometheusRule objects in.")
+	kubeflag := flag.String("kubeconfig", "", "Kubernetes configuration file.")
+	inCluster := flag.Bool("in-cluster", false, "Upload to the cluster we are running in, using the pod's service account, instead of using a kubernetes configuration file.")
+	inClusterContext := flag.String("in-cluster-context", "in-cluster", "Context name used for the cluster we are running in, with --in-cluster.")
+	flagContexts := flag.String("contexts", "", "Comma-separated list of contexts, or groups of contexts from the context manifest, to push configuration to.")
+	contextSelector := flag.String("context-selector", "", "Label selector picking contexts from the context manifest to push configuration to, in addition to --contexts.")
+	prometheus := flag.String("prometheus", "", "Name of the prometheus to push configuration for, for contexts that do not set their own.")
+	namespace := flag.String("namespace", "", "The namespace we should create PrometheusRule objects in, for contexts that do not set their own.")
 	dryRun := flag.Bool("dry-run", false, "Skip uploading, instead print the resulting PrometheusRuleList to stdout.")
+	showDiff := flag.Bool("diff", false, "Skip uploading, instead show a diff between the existing and the generated PrometheusRules in each context.")
+	outputDir := flag.String("output-dir", "", "Skip uploading, instead write manifests to <output-dir>/<context>/, removing stale ones.")
+	outputFormat := flag.String("output-format", prometheusRuleFormat, "Format to upload or write rules in, one of prometheusrule, configmap or rulefiles. rulefiles needs --output-dir.")
+	configMapFlag := flag.String("config-map-name", "", "Name of the ConfigMap holding the rules, with --output-format configmap. Defaults to <prometheus>-rule-files.")
+	prometheusURL := flag.String("prometheus-url", "", "Ask the prometheus at this URL to reload its configuration after uploading rules or writing rule files, for contexts that do not set their own. Best-effort for ConfigMaps, which take a while to be updated in the pod.")
+	nameTemplate := flag.String("name-template", "", "Template PrometheusRules are named by, for contexts that do not set their own. Defaults to "+cfgloader.DefaultNameTemplate+".")
+	extraLabels := flag.String("labels", "", "Comma-separated list of key=value labels to set on every PrometheusRule, values are templates like --name-template.")
+	extraAnnotations := flag.String("annotations", "", "Comma-separated list of key=value annotations to set on every PrometheusRule, values are templates like --name-template.")
+	prune := flag.Bool("prune", false, "Delete PrometheusRules for this prometheus that no longer have a source rule file.")
+	checkerName := flag.String("checker", "auto", "Syntax checker to use, one of auto, promtool or native.")
+	lintPolicy := flag.String("lint-policy", "", "Check rule files against the lint policy in this file.")
 	skipSyntax := flag.Bool("skip-syntax-check", false, "Bypass syntax checks of the source prometheus configuration.")
 	skipUnits := flag.Bool("skip-unit-tests", false, "Bypass running prometheus unit tests.")
+	splitOversized := flag.Bool("split-oversized", false, "Split rule files too large for a single PrometheusRule into several, along group boundaries, instead of failing.")
+	strict := flag.Bool("strict", true, "Reject rule, unit test and variables files with unknown fields or duplicate keys.")
+	allowMissing := flag.Bool("allow-missing-values", false, "Expand references to values that are not set as \"<no value>\", instead of failing.")
+	templateTests := flag.Bool("template-tests", false, "Template-expand unit test files, like rule files.")
+	testAllContexts := flag.Bool("test-all-contexts", false, "Run unit tests against the rules expanded for every selected context, not only the unittest context.")
+	junitReport := flag.String("junit-report", "", "Write the results of syntax checks and unit tests as JUnit XML to this file.")
+	jsonReport := flag.String("json-report", "", "Write the results of syntax checks and unit tests as JSON to this file.")
+	forceConflicts := flag.Bool("force-conflicts", false, "Take ownership of fields in existing PrometheusRules that are managed by someone else.")
+	rulerURL := flag.String("ruler-url", "", "Upload to the rules API of the ruler at this URL, instead of creating PrometheusRules, for contexts that do not set their own.")
+	rulerTenant := flag.String("ruler-tenant", "", "Tenant ID to upload rules to the ruler as, for contexts that do not set their own.")
+	rulerUsername := flag.String("ruler-username", "", "Username for basic authentication to the ruler.")
+	rulerPasswordFile := flag.String("ruler-password-file", "", "File holding the password for basic authentication to the ruler.")
+	rulerTokenFile := flag.String("ruler-bearer-token-file", "", "File holding a bearer token to authenticate to the ruler with.")
+	parallelism := flag.Int("parallelism", 1, "Number of contexts to upload to concurrently.")
 
 	flag.Parse()
 
-	kubeconfig := kubeConfigFile(*kubeflag)
-	contexts := strings.Split(*flagContexts, ",")
-	cfg := loadKubeConfig(kubeconfig)
-	if !validateContexts(cfg, contexts) {
-		log.Print("Failed to validate passed-in contexts.")
-		log.Print("Contexts specified that do not exist in the configuration:")
-		for _, ctx := range contexts {
-			_, ok := cfg.Contexts[ctx]
-			if !ok {
-				log.Printf("    %s", ctx)
-			}
+	if *parallelism < 1 {
+		log.Fatalf("--parallelism must be at least 1, not %d", *parallelism)
+	}
+
+	switch *outputFormat {
+	case prometheusRuleFormat, configMapFormat:
+	case ruleFilesFormat:
+		if *outputDir == "" {
+			log.Fatalf("--output-format %s needs --output-dir.", ruleFilesFormat)
 		}
-		os.Exit(1)
+	default:
+		log.Fatalf("Unknown --output-format %s.", *outputFormat)
 	}
 
-	// All configured and basic validation done. Next, template expansion.
 	if len(flag.Args()) == 0 {
 		log.Fatalf("No source directory specified.")
 	}
 	sourceDir := flag.Arg(0)
+	tplOpts := templates.Options{
+		Strict:             *strict,
+		ExpandTests:        *templateTests,
+		AllowMissingValues: *allowMissing,
+	}
+	manifest, err := templates.LoadManifest(sourceDir, tplOpts)
+	if err != nil {
+		log.Fatalf("Failed to load context manifest, %s", err)
+	}
+	contextNames := *flagContexts
+	if *inCluster && contextNames == "" && *contextSelector == "" {
+		contextNames = *inClusterContext
+	}
+	contexts, err := manifest.Select(strings.Split(contextNames, ","), *contextSelector)
+	if err != nil {
+		log.Fatalf("Failed to select contexts, %s", err)
+	}
+	if len(contexts) == 0 {
+		log.Fatalf("No contexts selected.")
+	}
+	log.Printf("Selected contexts %s", strings.Join(contexts, ", "))
+
+	if *inCluster {
+		if *kubeflag != "" {
+			log.Fatalf("--kubeconfig and --in-cluster can not be used together.")
+		}
+		if *inClusterContext == unitTestContextName {
+			log.Fatalf("--in-cluster-context can not be %s.", unitTestContextName)
+		}
+	}
+	labels, err := parseKeyValues(*extraLabels)
+	if err != nil {
+		log.Fatalf("Invalid --labels, %s", err)
+	}
+	annotations, err := parseKeyValues(*extraAnnotations)
+	if err != nil {
+		log.Fatalf("Invalid --annotations, %s", err)
+	}
+	auth, err := loadRulerAuth(*rulerUsername, *rulerPasswordFile, *rulerTokenFile)
+	if err != nil {
+		log.Fatalf("Failed to load ruler credentials, %s", err)
+	}
+
+	// Template expansion comes first, as the values can decide where
+	// the rules for each context go.
+	targets := contexts
 	contexts = append([]string{unitTestContextName}, contexts...)
 	log.Printf("About to template-expand %s", sourceDir)
-	tplData, err := templates.ExpandDirectory(contexts, sourceDir)
+	tplData, err := templates.ExpandDirectory(contexts, sourceDir, tplOpts)
 	if err != nil {
 		log.Fatalf("Failed to expand directories, %s", err)
 	}
+	// --namespace only comes after the namespace of the kubeconfig
+	// context, see defaultNamespaces.
+	defaults := ruleTarget{
+		Prometheus:    *prometheus,
+		RulerURL:      *rulerURL,
+		Tenant:        *rulerTenant,
+		PrometheusURL: *prometheusURL,
+		NameTemplate:  *nameTemplate,
+		Labels:        labels,
+		Annotations:   annotations,
+	}
+	ruleTargets := resolveTargets(targets, tplData, manifest, defaults)
 
-	// We should now have all our templates expanded.
-	prom, err := promtool.New()
-	if err != nil {
-		log.Fatalf("Failed to find promtool, %s", err)
+	// Contexts uploading to a cluster need a kubernetes configuration.
+	// In-cluster, the pod's service account is used rather than a
+	// kubernetes configuration file. When only writing manifests, we
+	// never talk to a cluster, so there is no need for either.
+	var cfg *clientapi.Config
+	kubeTargets := kubeContexts(ruleTargets, targets)
+	if *outputDir == "" && len(kubeTargets) > 0 {
+		if *inCluster {
+			cfg, err = loadInClusterConfig(*inClusterContext, *namespace)
+			if err != nil {
+				log.Fatalf("Failed to load in-cluster configuration, %s", err)
+			}
+		} else {
+			cfg = loadKubeConfig(kubeConfigFile(*kubeflag))
+		}
+		if !validateContexts(cfg, kubeTargets) {
+			log.Print("Failed to validate passed-in contexts.")
+			log.Print("Contexts specified that do not exist in the configuration:")
+			for _, ctx := range kubeTargets {
+				_, ok := cfg.Contexts[ctx]
+				if !ok {
+					log.Printf("    %s", ctx)
+				}
+			}
+			os.Exit(1)
+		}
+		defaultNamespaces(ruleTargets, cfg, *namespace)
+
+		missingNamespace := false
+		for _, context := range kubeTargets {
+			if ruleTargets[context].Namespace == "" {
+				log.Printf("ERROR: no namespace for context %s", context)
+				missingNamespace = true
+			}
+		}
+		if missingNamespace {
+			log.Fatalf("Namespaces missing, set --namespace, or a namespace for each context.")
+		}
+	} else {
+		defaultNamespaces(ruleTargets, nil, *namespace)
+	}
+	for _, context := range targets {
+		log.Printf("Context %s: %s", context, ruleTargets[context])
 	}
 
-	// Start with syntax checks
+	// We should now have all our templates expanded.
+	prom, promErr := promtool.New()
+
+	// Start with syntax checks, then linting and unit tests. All of
+	// them run for all files, so every failure is reported.
+	var checks []checkResult
 	if *skipSyntax {
 		log.Printf("WARNING: syntax-checking is disabled.")
 	} else {
-		err = doSyntaxChecks(prom, tplData)
+		checker, err := selectChecker(*checkerName, prom)
 		if err != nil {
-			log.Fatalf("Failed syntax-checking:\n%s", err)
+			log.Fatalf("Failed to set up syntax-checking, %s", err)
 		}
+		checks = append(checks, doSyntaxChecks(checker, tplData)...)
+	}
+
+	if *lintPolicy != "" {
+		policy, err := lint.LoadPolicy(*lintPolicy)
+		if err != nil {
+			log.Fatalf("Failed to load lint policy, %s", err)
+		}
+		checks = append(checks, doLint(policy, tplData)...)
 	}
 
-	// Then, unit-tests
 	if *skipUnits {
 		log.Printf("WARNING: unit-testing is disabled.")
+	} else if !hasUnitTests(tplData, *testAllContexts) {
+		log.Printf("No unit tests found, skipping unit-testing.")
 	} else {
-		err = doUnitTests(prom, tplData)
-		if err != nil {
-			log.Fatalf("Failed unit-testing:\n%s", err)
+		if prom == nil {
+			log.Fatalf("Failed to find promtool, needed for unit-testing, %s", promErr)
 		}
+		checks = append(checks, doUnitTests(prom, tplData, *testAllContexts)...)
+	}
+
+	err = writeReports(checks, *junitReport, *jsonReport)
+	if err != nil {
+		log.Fatalf("Failed to write reports, %s", err)
+	}
+	if failed := countFailures(checks); failed > 0 {
+		log.Fatalf("%d of %d checks failed.", failed, len(checks))
+	}
+
+	prov, err := loadProvenance(sourceDir, time.Now())
+	if err != nil {
+		log.Printf("WARNING: failed to read the git commit of %s, %s", sourceDir, err)
 	}
 
 	// We should now be good to go
-	for _, ctx := range contexts {
-		tpl := tplData[ctx]
-		uploadPrometheusRules(tpl, cfg, *dryRun, *prometheus, *namespace)
+	opts := uploadOptions{
+		dryRun:         *dryRun,
+		showDiff:       *showDiff,
+		prune:          *prune,
+		outputDir:      *outputDir,
+		outputFormat:   *outputFormat,
+		configMapName:  *configMapFlag,
+		targets:        ruleTargets,
+		forceConflicts: *forceConflicts,
+		rulerAuth:      auth,
+		provenance:     prov,
+		strict:         *strict,
+		splitOversized: *splitOversized,
+	}
+	rules, errs := loadRules(targets, tplData, opts)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("ERROR: %s", err)
+		}
+		log.Fatalf("Failed to load prometheus rules, %d problems found, aborting.", len(errs))
+	}
+	results := uploadAll(targets, rules, cfg, opts, *parallelism)
+	writeResults(os.Stderr, results)
+	for _, result := range results {
+		if result.Err != nil {
+			os.Exit(1)
+		}
 	}
 }
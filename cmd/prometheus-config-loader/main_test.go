@@ -0,0 +1,1293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	monitoringv1 "github.com/coreos/prometheus-operator/pkg/client/versioned"
+	"github.com/coreos/prometheus-operator/pkg/client/versioned/fake"
+	yaml "gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader"
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+	"github.com/G-Research/prometheus-config-loader/promtool"
+	"github.com/G-Research/prometheus-config-loader/ruler/rulertest"
+	"github.com/G-Research/prometheus-config-loader/templates"
+)
+
+func makeRule(name, namespace, prometheus string) *v1.PrometheusRule {
+	rv := &v1.PrometheusRule{}
+	rv.SetName(name)
+	rv.SetNamespace(namespace)
+	rv.SetLabels(map[string]string{"prometheus": prometheus, "role": "prometheus-rulefiles"})
+	return rv
+}
+
+func TestPruneRules(t *testing.T) {
+	cases := []struct {
+		dryRun   bool
+		expected []string
+	}{
+		{true, []string{"prom-kept-rules", "prom-renamed-rules", "other-old-rules", "prom-elsewhere-rules"}},
+		{false, []string{"prom-kept-rules", "other-old-rules", "prom-elsewhere-rules"}},
+	}
+
+	for ix, td := range cases {
+		api := fake.NewSimpleClientset(
+			makeRule("prom-kept-rules", "monitoring", "prom"),
+			makeRule("prom-renamed-rules", "monitoring", "prom"),
+			makeRule("other-old-rules", "monitoring", "other"),
+			makeRule("prom-elsewhere-rules", "elsewhere", "prom"),
+		)
+		loaded := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{
+			makeRule("prom-kept-rules", "monitoring", "prom"),
+		}}
+
+		err := pruneRules(&crdSink{api: api, namespace: "monitoring", prometheus: "prom"}, loaded, "test", td.dryRun)
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error %s", ix, err)
+		}
+
+		for _, name := range td.expected {
+			ns := "monitoring"
+			if name == "prom-elsewhere-rules" {
+				ns = "elsewhere"
+			}
+			if _, err := api.MonitoringV1().PrometheusRules(ns).Get(name, metav1.GetOptions{}); err != nil {
+				t.Errorf("Case #%d, expected %s/%s to still exist, %s", ix, ns, name, err)
+			}
+		}
+		if !td.dryRun {
+			if _, err := api.MonitoringV1().PrometheusRules("monitoring").Get("prom-renamed-rules", metav1.GetOptions{}); err == nil {
+				t.Errorf("Case #%d, expected prom-renamed-rules to be pruned", ix)
+			}
+		}
+	}
+}
+
+func TestStaleRules(t *testing.T) {
+	api := fake.NewSimpleClientset(
+		makeRule("prom-b-rules", "monitoring", "prom"),
+		makeRule("prom-a-rules", "monitoring", "prom"),
+		makeRule("prom-c-rules", "monitoring", "prom"),
+	)
+	loaded := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{
+		makeRule("prom-c-rules", "monitoring", "prom"),
+		makeRule("prom-new-rules", "monitoring", "prom"),
+	}}
+
+	seen, err := staleRules(&crdSink{api: api, namespace: "monitoring", prometheus: "prom"}, loaded)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	expected := []string{"prom-a-rules", "prom-b-rules"}
+	if len(seen) != len(expected) {
+		t.Fatalf("Saw %v, expected %v", seen, expected)
+	}
+	for ix := range expected {
+		if seen[ix] != expected[ix] {
+			t.Errorf("Position %d, saw %s expected %s", ix, seen[ix], expected[ix])
+		}
+	}
+}
+
+func TestDiffPrometheusRules(t *testing.T) {
+	changed := makeRule("prom-changed-rules", "monitoring", "prom")
+	changed.Spec.Groups = []v1.RuleGroup{{Name: "old"}}
+	api := fake.NewSimpleClientset(
+		makeRule("prom-same-rules", "monitoring", "prom"),
+		changed,
+		makeRule("prom-stale-rules", "monitoring", "prom"),
+	)
+
+	updated := makeRule("prom-changed-rules", "monitoring", "prom")
+	updated.Spec.Groups = []v1.RuleGroup{{Name: "new"}}
+	loaded := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{
+		makeRule("prom-same-rules", "monitoring", "prom"),
+		updated,
+		makeRule("prom-new-rules", "monitoring", "prom"),
+	}}
+
+	cases := []struct {
+		prune    bool
+		expected diffSummary
+	}{
+		{false, diffSummary{
+			Created:   []string{"prom-new-rules"},
+			Updated:   []string{"prom-changed-rules"},
+			Unchanged: []string{"prom-same-rules"},
+		}},
+		{true, diffSummary{
+			Created:   []string{"prom-new-rules"},
+			Updated:   []string{"prom-changed-rules"},
+			Unchanged: []string{"prom-same-rules"},
+			Pruned:    []string{"prom-stale-rules"},
+		}},
+	}
+
+	for ix, td := range cases {
+		var out bytes.Buffer
+		seen, err := diffPrometheusRules(&out, &crdSink{api: api, namespace: "monitoring", prometheus: "prom"}, loaded, "test", td.prune)
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error %s", ix, err)
+			continue
+		}
+		if !reflect.DeepEqual(seen, td.expected) {
+			t.Errorf("Case #%d, saw %v, expected %v", ix, seen, td.expected)
+		}
+		if !strings.Contains(out.String(), "-  - name: old\n+  - name: new\n") {
+			t.Errorf("Case #%d, diff output missing the group change:\n%s", ix, out.String())
+		}
+	}
+}
+
+func TestUploadAll(t *testing.T) {
+	// Writing manifests below a regular file fails
+	blocker, err := ioutil.TempFile("", "blocker")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file, %s", err)
+	}
+	blocker.Close()
+	defer os.Remove(blocker.Name())
+
+	rules := map[string]*v1.PrometheusRuleList{
+		"broken-1": &v1.PrometheusRuleList{},
+		"broken-2": &v1.PrometheusRuleList{},
+	}
+	contexts := []string{"broken-1", unitTestContextName, "broken-2"}
+	opts := uploadOptions{outputDir: blocker.Name()}
+
+	for _, parallelism := range []int{1, 2, 5} {
+		results := uploadAll(contexts, rules, nil, opts, parallelism)
+		if len(results) != len(contexts) {
+			t.Fatalf("Parallelism %d, saw %d results, expected %d", parallelism, len(results), len(contexts))
+		}
+		for ix, result := range results {
+			if result.Context != contexts[ix] {
+				t.Errorf("Parallelism %d, result %d is for %s, expected %s", parallelism, ix, result.Context, contexts[ix])
+			}
+			if (result.Err != nil) != (result.Context != unitTestContextName) {
+				t.Errorf("Parallelism %d, unexpected error status for %s, %v", parallelism, result.Context, result.Err)
+			}
+		}
+
+		var out bytes.Buffer
+		writeResults(&out, results)
+		if strings.Count(out.String(), "FAILED") != 2 {
+			t.Errorf("Parallelism %d, expected two failures in:\n%s", parallelism, out.String())
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	tplData := templates.ExpansionData{
+		unitTestContextName: templates.TemplateData{Context: unitTestContextName},
+		"missing":           templates.TemplateData{Context: "missing", Directory: "testdata/angry-wombats"},
+		"good":              templates.TemplateData{Context: "good", Directory: "../../cfgloader/testdata2"},
+		"bad":               templates.TemplateData{Context: "bad", Directory: "../../cfgloader/testdata"},
+	}
+
+	opts := uploadOptions{targets: map[string]ruleTarget{
+		"missing": {Prometheus: "prom"},
+		"good":    {Prometheus: "prom"},
+		"bad":     {Prometheus: "prom"},
+	}}
+	rules, errs := loadRules([]string{"good", unitTestContextName}, tplData, opts)
+	if len(errs) != 0 {
+		t.Errorf("Unexpected errors, %v", errs)
+	}
+	if _, ok := rules[unitTestContextName]; ok {
+		t.Errorf("Rules should not be loaded for the %s context", unitTestContextName)
+	}
+	if rules["good"] == nil || len(rules["good"].Items) == 0 {
+		t.Errorf("No rules loaded for good context")
+	}
+
+	_, errs = loadRules([]string{"missing", "good", "bad"}, tplData, opts)
+	if len(errs) < 2 {
+		t.Fatalf("Expected errors from both the missing and bad contexts, saw %v", errs)
+	}
+	for _, err := range errs {
+		if !strings.HasPrefix(err.Error(), "context missing: ") && !strings.HasPrefix(err.Error(), "context bad: ") {
+			t.Errorf("Unexpected error %s", err)
+		}
+	}
+}
+
+func TestLoadRulesRuleFileFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rule-file-fields")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := "groups:\n- name: a\n  query_offset: 1m\n  rules:\n  - alert: b\n    expr: up == 0\n    keep_firing_for: 5m\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tplData := templates.ExpansionData{"a": templates.TemplateData{Context: "a", Directory: dir}}
+
+	crd := uploadOptions{targets: map[string]ruleTarget{"a": {Prometheus: "prom"}}}
+	if _, errs := loadRules([]string{"a"}, tplData, crd); len(errs) != 2 {
+		t.Errorf("Expected both fields to be rejected for PrometheusRules, saw %v", errs)
+	}
+
+	for _, opts := range []uploadOptions{
+		{targets: map[string]ruleTarget{"a": {Prometheus: "prom", RulerURL: "http://ruler"}}},
+		{targets: map[string]ruleTarget{"a": {Prometheus: "prom"}}, outputFormat: configMapFormat},
+		{targets: map[string]ruleTarget{"a": {Prometheus: "prom"}}, outputFormat: ruleFilesFormat},
+	} {
+		rules, errs := loadRules([]string{"a"}, tplData, opts)
+		if len(errs) != 0 {
+			t.Errorf("Unexpected errors for %+v, %v", opts, errs)
+			continue
+		}
+		seen, err := renderRuleFile(rules["a"].Items[0])
+		if err != nil {
+			t.Errorf("Unexpected error rendering, %s", err)
+		}
+		if !strings.Contains(seen, "query_offset: 1m") || !strings.Contains(seen, "keep_firing_for: 5m") {
+			t.Errorf("Fields missing from rule file:\n%s", seen)
+		}
+	}
+}
+
+func TestWriteManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifests")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Left over from a previous run, should be removed
+	err = ioutil.WriteFile(filepath.Join(dir, "prom-old-rules.yaml"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create stale manifest, %s", err)
+	}
+	// Not something we generate, should be left alone
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create README, %s", err)
+	}
+
+	rules := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{
+		makeRule("prom-b-rules", "monitoring", "prom"),
+		makeRule("prom-a-rules", "monitoring", "prom"),
+	}}
+	written, err := writeManifests(rules, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if !reflect.DeepEqual(written, []string{"prom-a-rules.yaml", "prom-b-rules.yaml"}) {
+		t.Errorf("Unexpected files written, %v", written)
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	var seen []string
+	for _, name := range names {
+		seen = append(seen, filepath.Base(name))
+	}
+	expected := []string{"README", "kustomization.yaml", "prom-a-rules.yaml", "prom-b-rules.yaml"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Saw files %v, expected %v", seen, expected)
+	}
+
+	manifest, _ := ioutil.ReadFile(filepath.Join(dir, "prom-a-rules.yaml"))
+	for _, want := range []string{"apiVersion: monitoring.coreos.com/v1\n", "kind: PrometheusRule\n", "name: prom-a-rules\n"} {
+		if !strings.Contains(string(manifest), want) {
+			t.Errorf("Manifest does not contain %q:\n%s", want, manifest)
+		}
+	}
+	kustomization, _ := ioutil.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	if !strings.Contains(string(kustomization), "resources:\n- prom-a-rules.yaml\n- prom-b-rules.yaml\n") {
+		t.Errorf("Unexpected kustomization:\n%s", kustomization)
+	}
+}
+
+// failingChecker fails every file whose base name is in the map, with
+// the error given.
+type failingChecker map[string]error
+
+func (f failingChecker) Check(file string) (string, error) {
+	if err, ok := f[filepath.Base(file)]; ok {
+		return "", err
+	}
+	return "SUCCESS\n", nil
+}
+
+func TestDoSyntaxChecks(t *testing.T) {
+	tplData := templates.ExpansionData{
+		"b": templates.TemplateData{Context: "b", Directory: "dir-b", Files: []string{"good.yaml", "bad.yaml", "tests/good.yaml"}},
+		"a": templates.TemplateData{Context: "a", Directory: "dir-a", Files: []string{"bad.yaml", "good.yaml"}},
+	}
+	checker := failingChecker{"bad.yaml": promtool.PromtoolError{
+		Stdout:        "checking bad.yaml",
+		Stderr:        "bad things",
+		OriginalError: errors.New("exit status 1"),
+	}}
+
+	results := doSyntaxChecks(checker, tplData)
+	var seen []string
+	for _, result := range results {
+		seen = append(seen, fmt.Sprintf("%s/%s/%v", result.Context, result.File, result.Passed))
+	}
+	expected := []string{"a/bad.yaml/false", "a/good.yaml/true", "b/good.yaml/true", "b/bad.yaml/false"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("Saw %v, expected %v", seen, expected)
+	}
+	if countFailures(results) != 2 {
+		t.Errorf("Saw %d failures, expected 2", countFailures(results))
+	}
+	bad := results[0]
+	if bad.Stdout != "checking bad.yaml" || bad.Stderr != "bad things" || bad.Error != "exit status 1" {
+		t.Errorf("Promtool output not recorded, %+v", bad)
+	}
+	if results[1].Stdout != "SUCCESS\n" {
+		t.Errorf("Checker output not recorded, %+v", results[1])
+	}
+}
+
+func TestHasUnitTests(t *testing.T) {
+	tplData := templates.ExpansionData{
+		"unittest": templates.TemplateData{Context: "unittest", Files: []string{"good.yaml"}},
+		"a":        templates.TemplateData{Context: "a", Files: []string{"good.yaml", "tests/good.yaml"}},
+	}
+	if hasUnitTests(tplData, false) {
+		t.Errorf("Expected no unit tests for the unittest context")
+	}
+	if !hasUnitTests(tplData, true) {
+		t.Errorf("Expected unit tests for all contexts")
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	results := []checkResult{
+		{Phase: syntaxPhase, Context: "a", File: "good.yaml", Passed: true, Duration: time.Second},
+		{Phase: syntaxPhase, Context: "a", File: "bad.yaml", Error: "exit status 1", Stderr: "bad <things>"},
+		{Phase: unitTestPhase, Context: unitTestContextName, File: "tests/good.yaml", Passed: true},
+	}
+
+	var junit bytes.Buffer
+	if err := writeJUnit(&junit, results); err != nil {
+		t.Fatalf("Unexpected error writing JUnit, %s", err)
+	}
+	for _, want := range []string{
+		`<testsuite name="syntax/a" tests="2" failures="1" time="1.000">`,
+		`<testcase name="bad.yaml" classname="a" time="0.000">`,
+		`<failure message="exit status 1">bad &lt;things&gt;</failure>`,
+		`<testsuite name="unit-test/unittest" tests="1" failures="0" time="0.000">`,
+	} {
+		if !strings.Contains(junit.String(), want) {
+			t.Errorf("JUnit report does not contain %q:\n%s", want, junit.String())
+		}
+	}
+
+	var js bytes.Buffer
+	if err := writeJSON(&js, results); err != nil {
+		t.Fatalf("Unexpected error writing JSON, %s", err)
+	}
+	var decoded []checkResult
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode JSON report, %s", err)
+	}
+	if !reflect.DeepEqual(decoded, results) {
+		t.Errorf("JSON report round-tripped to %+v, expected %+v", decoded, results)
+	}
+}
+
+func TestImportFileName(t *testing.T) {
+	cases := []struct {
+		name, prometheus, expected string
+	}{
+		{"k8s-node-rules", "k8s", "node"},
+		{"k8s-databases.postgres-rules", "k8s", "databases.postgres"},
+		{"k8s-rules", "k8s", "k8s-rules"},
+		{"other-node-rules", "k8s", "other-node-rules"},
+		{"k8s-node-rules", "", "k8s-node-rules"},
+		{"k8s-node-rules-part-2", "k8s", "node"},
+		{"k8s-node-part-2", "k8s", "k8s-node-part-2"},
+	}
+
+	for ix, td := range cases {
+		if seen := importFileName(td.name, td.prometheus); seen != td.expected {
+			t.Errorf("Case #%d, saw %s, expected %s", ix, seen, td.expected)
+		}
+	}
+}
+
+func TestReadSource(t *testing.T) {
+	api := fake.NewSimpleClientset(
+		makeRule("k8s-node-rules", "monitoring", "k8s"),
+		makeRule("other-node-rules", "monitoring", "other"),
+		makeRule("k8s-elsewhere-rules", "default", "k8s"),
+		makeRule("k8s-big-rules-part-1", "monitoring", "k8s"),
+		makeRule("k8s-big-rules-part-2", "monitoring", "k8s"),
+	)
+
+	source, count, err := readSource(api, "monitoring", "k8s")
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if _, ok := source["node"]; !ok || len(source) != 2 {
+		t.Errorf("Expected the node and big rule files, saw %v", source)
+	}
+	if count != 3 {
+		t.Errorf("Saw %d PrometheusRules read, expected 3", count)
+	}
+
+	source, count, err = readSource(api, "monitoring", "")
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if len(source) != 4 || count != 4 {
+		t.Errorf("Expected every PrometheusRule in the namespace, saw %d in %v", count, source)
+	}
+}
+
+// statusHandler replies to every request with the status code for the
+// method, recording the requests seen.
+type statusHandler struct {
+	codes    map[string]int
+	requests []*http.Request
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requests = append(h.requests, r)
+	code, ok := h.codes[r.Method]
+	if !ok {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if code == http.StatusOK {
+		json.NewEncoder(w).Encode(makeRule("k8s-node-rules", "monitoring", "k8s"))
+		return
+	}
+	reasons := map[int]metav1.StatusReason{
+		http.StatusConflict:             metav1.StatusReasonConflict,
+		http.StatusForbidden:            metav1.StatusReasonForbidden,
+		http.StatusUnsupportedMediaType: metav1.StatusReasonUnsupportedMediaType,
+	}
+	reason := reasons[code]
+	if r.Method == http.MethodPost && code == http.StatusConflict {
+		reason = metav1.StatusReasonAlreadyExists
+	}
+	status := metav1.Status{Status: metav1.StatusFailure, Code: int32(code), Reason: reason}
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	json.NewEncoder(w).Encode(status)
+}
+
+func TestApplyRule(t *testing.T) {
+	cases := []struct {
+		codes    map[string]int
+		force    bool
+		methods  []string
+		errorMsg string
+	}{
+		{nil, false, []string{"PATCH"}, ""},
+		{nil, true, []string{"PATCH"}, ""},
+		{map[string]int{"PATCH": http.StatusConflict}, false, []string{"PATCH"}, "--force-conflicts"},
+		{map[string]int{"PATCH": http.StatusForbidden}, false, []string{"PATCH"}, "not allowed"},
+		{map[string]int{"PATCH": http.StatusUnsupportedMediaType}, false, []string{"PATCH", "POST"}, ""},
+		{map[string]int{"PATCH": http.StatusUnsupportedMediaType, "POST": http.StatusConflict}, false, []string{"PATCH", "POST", "GET", "PUT"}, ""},
+		{map[string]int{"PATCH": http.StatusUnsupportedMediaType, "POST": http.StatusForbidden}, false, []string{"PATCH", "POST"}, "not allowed"},
+		{map[string]int{"PATCH": http.StatusUnsupportedMediaType, "POST": http.StatusConflict, "PUT": http.StatusConflict}, false, []string{"PATCH", "POST", "GET", "PUT"}, "try again"},
+	}
+
+	for ix, td := range cases {
+		handler := &statusHandler{codes: td.codes}
+		server := httptest.NewServer(handler)
+		api, err := monitoringv1.NewForConfig(&rest.Config{Host: server.URL})
+		if err != nil {
+			t.Fatalf("Case #%d, failed to create client, %s", ix, err)
+		}
+
+		var out bytes.Buffer
+		err = applyRule(&out, api, "monitoring", makeRule("k8s-node-rules", "", "k8s"), td.force)
+		server.Close()
+
+		switch {
+		case td.errorMsg == "" && err != nil:
+			t.Errorf("Case #%d, unexpected error, %s", ix, err)
+		case td.errorMsg != "" && (err == nil || !strings.Contains(err.Error(), td.errorMsg)):
+			t.Errorf("Case #%d, expected an error containing %q, saw %v", ix, td.errorMsg, err)
+		}
+
+		var methods []string
+		for _, r := range handler.requests {
+			methods = append(methods, r.Method)
+		}
+		if !reflect.DeepEqual(methods, td.methods) {
+			t.Errorf("Case #%d, saw requests %v, expected %v", ix, methods, td.methods)
+			continue
+		}
+
+		patch := handler.requests[0]
+		if patch.Header.Get("Content-Type") != string(applyPatchType) {
+			t.Errorf("Case #%d, saw content type %s", ix, patch.Header.Get("Content-Type"))
+		}
+		if patch.URL.Path != "/apis/monitoring.coreos.com/v1/namespaces/monitoring/prometheusrules/k8s-node-rules" {
+			t.Errorf("Case #%d, saw path %s", ix, patch.URL.Path)
+		}
+		if patch.URL.Query().Get("fieldManager") != fieldManager {
+			t.Errorf("Case #%d, saw field manager %q", ix, patch.URL.Query().Get("fieldManager"))
+		}
+		if (patch.URL.Query().Get("force") == "true") != td.force {
+			t.Errorf("Case #%d, saw force %q", ix, patch.URL.Query().Get("force"))
+		}
+	}
+}
+
+func TestInClusterKubeConfig(t *testing.T) {
+	token, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatalf("Failed to create token file, %s", err)
+	}
+	defer os.Remove(token.Name())
+	token.WriteString("secret")
+	token.Close()
+	defer func(old string) { serviceAccountTokenFile = old }(serviceAccountTokenFile)
+	serviceAccountTokenFile = token.Name()
+
+	cfg := inClusterKubeConfig("local", "https://10.0.0.1:443", "", "monitoring")
+	if !validateContexts(cfg, []string{"local"}) {
+		t.Errorf("Expected the local context to exist")
+	}
+	if validateContexts(cfg, []string{"local", "other"}) {
+		t.Errorf("Expected only the local context to exist")
+	}
+
+	cc := clientcmd.NewDefaultClientConfig(*cfg, &clientcmd.ConfigOverrides{CurrentContext: "local"})
+	rc, err := cc.ClientConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if rc.Host != "https://10.0.0.1:443" {
+		t.Errorf("Saw host %s", rc.Host)
+	}
+	namespace, _, err := cc.Namespace()
+	if err != nil || namespace != "monitoring" {
+		t.Errorf("Saw namespace %s, expected monitoring, %v", namespace, err)
+	}
+}
+
+func TestResolveTargets(t *testing.T) {
+	manifest := &templates.Manifest{Contexts: map[string]map[string]string{
+		"labelled": {"namespace": "prometheus-system", "prometheus": "system"},
+		"ruler":    {"ruler_url": "https://mimir.example.com", "tenant": "team-a"},
+	}}
+	target := func(values map[string]interface{}) templates.Values {
+		return templates.Values{Values: map[string]interface{}{"target": values}}
+	}
+	tplData := templates.ExpansionData{
+		"labelled":  {Values: target(map[string]interface{}{"namespace": "ignored"})},
+		"vars":      {Values: target(map[string]interface{}{"namespace": "from-vars", "prometheus": "k8s"})},
+		"kube":      {},
+		"defaulted": {Values: target(map[string]interface{}{"prometheus": "other"})},
+		"ruler":     {Values: target(map[string]interface{}{"tenant": "ignored", "prometheus": "mimir"})},
+	}
+	contexts := []string{"labelled", "vars", "kube", "defaulted", "ruler"}
+	cfg := inClusterKubeConfig("kube", "https://10.0.0.1:443", "", "from-kubeconfig")
+	cfg.Contexts["defaulted"] = cfg.Contexts["kube"]
+
+	cases := []struct {
+		defaults ruleTarget
+		// --namespace
+		namespace string
+		expected  map[string]ruleTarget
+	}{
+		{ruleTarget{}, "", map[string]ruleTarget{
+			"labelled":  {Namespace: "prometheus-system", Prometheus: "system"},
+			"vars":      {Namespace: "from-vars", Prometheus: "k8s"},
+			"kube":      {Namespace: "from-kubeconfig"},
+			"defaulted": {Namespace: "from-kubeconfig", Prometheus: "other"},
+			"ruler":     {Prometheus: "mimir", RulerURL: "https://mimir.example.com", Tenant: "team-a"},
+		}},
+		// The kubeconfig namespace comes before --namespace
+		{ruleTarget{Prometheus: "default", Tenant: "default"}, "monitoring", map[string]ruleTarget{
+			"labelled":  {Namespace: "prometheus-system", Prometheus: "system", Tenant: "default"},
+			"vars":      {Namespace: "from-vars", Prometheus: "k8s", Tenant: "default"},
+			"kube":      {Namespace: "from-kubeconfig", Prometheus: "default", Tenant: "default"},
+			"defaulted": {Namespace: "from-kubeconfig", Prometheus: "other", Tenant: "default"},
+			"ruler":     {Namespace: "monitoring", Prometheus: "mimir", RulerURL: "https://mimir.example.com", Tenant: "team-a"},
+		}},
+	}
+
+	for ix, td := range cases {
+		seen := resolveTargets(contexts, tplData, manifest, td.defaults)
+		defaultNamespaces(seen, cfg, td.namespace)
+		if !reflect.DeepEqual(seen, td.expected) {
+			t.Errorf("Case #%d, saw %v, expected %v", ix, seen, td.expected)
+		}
+		if kube := kubeContexts(seen, contexts); !reflect.DeepEqual(kube, contexts[:4]) {
+			t.Errorf("Case #%d, saw kubernetes contexts %v", ix, kube)
+		}
+	}
+}
+
+func TestResolveTargetNaming(t *testing.T) {
+	manifest := &templates.Manifest{Contexts: map[string]map[string]string{
+		"labelled": {"name_template": "{{ .Name }}"},
+	}}
+	tplData := templates.ExpansionData{
+		"labelled": {},
+		"vars": {Values: templates.Values{Values: map[string]interface{}{"target": map[string]interface{}{
+			"name_template": "{{ .Prometheus }}-{{ .Name }}",
+			"labels":        map[string]interface{}{"team": "db", "tier": 1},
+			"annotations":   map[string]interface{}{"example.com/owner": "db-team"},
+		}}}},
+	}
+	defaults := ruleTarget{
+		NameTemplate: "rules-{{ .Name }}",
+		Labels:       map[string]string{"team": "sre", "env": "prod"},
+		Annotations:  map[string]string{"example.com/commit": "abc123"},
+	}
+	expected := map[string]ruleTarget{
+		"labelled": {
+			NameTemplate: "{{ .Name }}",
+			Labels:       map[string]string{"team": "sre", "env": "prod"},
+			Annotations:  map[string]string{"example.com/commit": "abc123"},
+		},
+		"vars": {
+			NameTemplate: "{{ .Prometheus }}-{{ .Name }}",
+			Labels:       map[string]string{"team": "db", "env": "prod", "tier": "1"},
+			Annotations:  map[string]string{"example.com/commit": "abc123", "example.com/owner": "db-team"},
+		},
+	}
+
+	seen := resolveTargets([]string{"labelled", "vars"}, tplData, manifest, defaults)
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Saw %v, expected %v", seen, expected)
+	}
+	if l := seen["vars"].loader(); l.NameTemplate != "{{ .Prometheus }}-{{ .Name }}" || l.Labels["team"] != "db" {
+		t.Errorf("Unexpected loader %v", l)
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected map[string]string
+		fail     bool
+	}{
+		{"", nil, false},
+		{"team=sre", map[string]string{"team": "sre"}, false},
+		{"team=sre,source={{ .File }},empty=", map[string]string{"team": "sre", "source": "{{ .File }}", "empty": ""}, false},
+		{"team", nil, true},
+		{"=sre", nil, true},
+	}
+
+	for ix, td := range cases {
+		seen, err := parseKeyValues(td.s)
+		if (err != nil) != td.fail {
+			t.Errorf("Case #%d, unexpected error status, %v", ix, err)
+		}
+		if !reflect.DeepEqual(seen, td.expected) {
+			t.Errorf("Case #%d, saw %v, expected %v", ix, seen, td.expected)
+		}
+	}
+}
+
+func TestRulerSink(t *testing.T) {
+	server := rulertest.NewServer()
+	defer server.Close()
+	server.Tenant = "team-a"
+	server.SetRules("team-a", "prom-stale-rules", []rulefmt.RuleGroup{{Name: "stale", Rules: []rulefmt.Rule{{Record: "a:b:c", Expr: "1"}}}})
+	server.SetRules("team-a", ownersNamespace, []rulefmt.RuleGroup{{Name: "prom/prom-stale-rules"}})
+	server.SetRules("team-a", "prom-someone-elses-rules", []rulefmt.RuleGroup{{Name: "other", Rules: []rulefmt.Rule{{Record: "a:b:c", Expr: "1"}}}})
+	server.SetRules("team-a", "someone-elses", []rulefmt.RuleGroup{{Name: "other", Rules: []rulefmt.Rule{{Record: "a:b:c", Expr: "1"}}}})
+	server.SetRules("team-a", "prom-changed-rules", []rulefmt.RuleGroup{
+		{Name: "old", Rules: []rulefmt.Rule{{Record: "a:b:c", Expr: "1"}}},
+		{Name: "kept", Rules: []rulefmt.Rule{{Record: "a:b:c", Expr: "1"}}},
+	})
+
+	s, err := newSink(nil, "mimir", ruleTarget{Prometheus: "prom", RulerURL: server.URL, Tenant: "team-a"}, uploadOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	changed := makeRule("prom-changed-rules", "", "prom")
+	changed.Spec.Groups = []v1.RuleGroup{
+		{Name: "kept", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString("2")}}},
+		{Name: "new", Rules: []v1.Rule{{Alert: "Down", Expr: intstr.FromString("up == 0")}}},
+	}
+	loaded := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{changed, makeRule("prom-new-rules", "", "prom")}}
+
+	var out bytes.Buffer
+	summary, err := diffPrometheusRules(&out, s, loaded, "mimir", true)
+	if err != nil {
+		t.Fatalf("Unexpected error diffing, %s", err)
+	}
+	expected := diffSummary{Created: []string{"prom-new-rules"}, Updated: []string{"prom-changed-rules"}, Pruned: []string{"prom-stale-rules"}}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Saw diff summary %v, expected %v", summary, expected)
+	}
+	if !strings.Contains(out.String(), "-- name: old\n") || !strings.Contains(out.String(), "+- name: new\n") {
+		t.Errorf("Diff output missing the group changes:\n%s", out.String())
+	}
+
+	for _, rule := range loaded.Items {
+		if err := s.Apply(&out, rule); err != nil {
+			t.Errorf("Unexpected error applying %s, %s", rule.GetName(), err)
+		}
+	}
+	if err := pruneRules(s, loaded, "mimir", false); err != nil {
+		t.Errorf("Unexpected error pruning, %s", err)
+	}
+
+	expectedGroups := cfgloader.RuleGroupsFromSpec(changed.Spec).Groups
+	if seen := server.Rules("team-a", "prom-changed-rules"); !reflect.DeepEqual(seen, expectedGroups) {
+		t.Errorf("Saw groups %v, expected %v", seen, expectedGroups)
+	}
+	if seen := server.Rules("team-a", "prom-stale-rules"); seen != nil {
+		t.Errorf("Expected prom-stale-rules to be pruned, saw %v", seen)
+	}
+	for _, name := range []string{"someone-elses", "prom-someone-elses-rules"} {
+		if seen := server.Rules("team-a", name); seen == nil {
+			t.Errorf("Expected %s to be left alone", name)
+		}
+	}
+	if names, err := s.List(); err != nil || !reflect.DeepEqual(names, []string{"prom-changed-rules", "prom-new-rules"}) {
+		t.Errorf("Saw rules %v, %v after pruning", names, err)
+	}
+
+	summary, err = diffPrometheusRules(&out, s, loaded, "mimir", true)
+	if err != nil || len(summary.Unchanged) != 1 || len(summary.Created) != 1 {
+		t.Errorf("Expected prom-changed-rules to be unchanged after applying, saw %v, %v", summary, err)
+	}
+}
+
+func TestRulerSinkPruneOwnership(t *testing.T) {
+	server := rulertest.NewServer()
+	defer server.Close()
+
+	// k8s-gpu-node-rules could be named for either prometheus, by the
+	// default template
+	sinks := make(map[string]sink)
+	for _, prometheus := range []string{"k8s", "k8s-gpu"} {
+		s, err := newSink(nil, "mimir", ruleTarget{Prometheus: prometheus, RulerURL: server.URL}, uploadOptions{})
+		if err != nil {
+			t.Fatalf("Unexpected error, %s", err)
+		}
+		sinks[prometheus] = s
+	}
+	for _, td := range []struct {
+		prometheus string
+		name       string
+	}{
+		{"k8s", "k8s-app-rules"},
+		{"k8s-gpu", "k8s-gpu-node-rules"},
+	} {
+		rule := makeRule(td.name, "", td.prometheus)
+		rule.Spec.Groups = []v1.RuleGroup{{Name: "a", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString("1")}}}}
+		if err := sinks[td.prometheus].Apply(ioutil.Discard, rule); err != nil {
+			t.Fatalf("Unexpected error applying %s, %s", td.name, err)
+		}
+	}
+
+	if err := pruneRules(sinks["k8s"], &v1.PrometheusRuleList{}, "mimir", false); err != nil {
+		t.Errorf("Unexpected error pruning, %s", err)
+	}
+	if seen := server.Rules("", "k8s-app-rules"); seen != nil {
+		t.Errorf("Expected k8s-app-rules to be pruned, saw %v", seen)
+	}
+	if seen := server.Rules("", "k8s-gpu-node-rules"); seen == nil {
+		t.Errorf("Expected k8s-gpu-node-rules to be left alone")
+	}
+	if names, err := sinks["k8s-gpu"].List(); err != nil || !reflect.DeepEqual(names, []string{"k8s-gpu-node-rules"}) {
+		t.Errorf("Saw rules %v, %v for k8s-gpu", names, err)
+	}
+
+	if err := sinks["k8s"].Apply(ioutil.Discard, makeRule(ownersNamespace, "", "k8s")); err == nil {
+		t.Errorf("Expected applying a rule named %s to fail", ownersNamespace)
+	}
+}
+
+// fakeConfigMaps keeps ConfigMaps in memory, implementing only the
+// parts of ConfigMapInterface the configMapSink uses.
+type fakeConfigMaps struct {
+	corev1client.ConfigMapInterface
+	items   map[string]*corev1.ConfigMap
+	updates int
+}
+
+func (f *fakeConfigMaps) Get(name string, opts metav1.GetOptions) (*corev1.ConfigMap, error) {
+	cm, ok := f.items[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(corev1.Resource("configmaps"), name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (f *fakeConfigMaps) Create(cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	if _, ok := f.items[cm.GetName()]; ok {
+		return nil, apierrors.NewAlreadyExists(corev1.Resource("configmaps"), cm.GetName())
+	}
+	f.items[cm.GetName()] = cm.DeepCopy()
+	f.updates++
+	return cm, nil
+}
+
+func (f *fakeConfigMaps) Update(cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	if _, ok := f.items[cm.GetName()]; !ok {
+		return nil, apierrors.NewNotFound(corev1.Resource("configmaps"), cm.GetName())
+	}
+	f.items[cm.GetName()] = cm.DeepCopy()
+	f.updates++
+	return cm, nil
+}
+
+func TestConfigMapSink(t *testing.T) {
+	api := &fakeConfigMaps{items: make(map[string]*corev1.ConfigMap)}
+	s := &configMapSink{configMaps: api, name: "prom-rule-files", namespace: "monitoring", prometheus: "prom"}
+
+	changed := makeRule("prom-changed-rules", "monitoring", "prom")
+	changed.Spec.Groups = []v1.RuleGroup{{Name: "a", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString("1")}}}}
+	if err := s.Apply(ioutil.Discard, changed); err != nil {
+		t.Fatalf("Unexpected error creating the ConfigMap, %s", err)
+	}
+	stale := makeRule("prom-stale-rules", "monitoring", "prom")
+	if err := s.Apply(ioutil.Discard, stale); err != nil {
+		t.Fatalf("Unexpected error updating the ConfigMap, %s", err)
+	}
+	api.items["prom-rule-files"].Data["extra.rules"] = "groups: []\n"
+	api.items["prom-rule-files"].Data["prom-extra-rules.yaml"] = "groups: []\n"
+
+	names, err := s.List()
+	if err != nil || !reflect.DeepEqual(names, []string{"prom-changed-rules", "prom-stale-rules"}) {
+		t.Errorf("Saw rules %v, %v", names, err)
+	}
+
+	changed.Spec.Groups[0].Rules[0].Expr = intstr.FromString("2")
+	loaded := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{changed, makeRule("prom-new-rules", "monitoring", "prom")}}
+	var out bytes.Buffer
+	summary, err := diffPrometheusRules(&out, s, loaded, "edge", true)
+	if err != nil {
+		t.Fatalf("Unexpected error diffing, %s", err)
+	}
+	expected := diffSummary{Created: []string{"prom-new-rules"}, Updated: []string{"prom-changed-rules"}, Pruned: []string{"prom-stale-rules"}}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Saw diff summary %v, expected %v", summary, expected)
+	}
+
+	api.updates = 0
+	if err := s.ApplyAll(&out, loaded, true); err != nil {
+		t.Fatalf("Unexpected error applying all rules, %s", err)
+	}
+	if api.updates != 1 {
+		t.Errorf("Expected a single update, saw %d", api.updates)
+	}
+	var keys []string
+	for key := range api.items["prom-rule-files"].Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"extra.rules", "prom-changed-rules.yaml", "prom-extra-rules.yaml", "prom-new-rules.yaml"}) {
+		t.Errorf("Unexpected keys in the ConfigMap, %v", keys)
+	}
+	if data := api.items["prom-rule-files"].Data["prom-changed-rules.yaml"]; !strings.Contains(data, "expr: \"2\"\n") {
+		t.Errorf("Unexpected rule file:\n%s", data)
+	}
+
+	huge := makeRule("prom-huge-rules", "monitoring", "prom")
+	huge.Spec.Groups = []v1.RuleGroup{{Name: "huge", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString(strings.Repeat("1+", maxConfigMapSize/2))}}}}
+	if err := s.Apply(&out, huge); err == nil || !strings.Contains(err.Error(), "more than the limit") {
+		t.Errorf("Expected the size check to fail, saw %v", err)
+	}
+	if _, ok := api.items["prom-rule-files"].Data["prom-huge-rules.yaml"]; ok {
+		t.Errorf("Expected the oversized ConfigMap not to be stored")
+	}
+}
+
+func TestConfigMapSinkOwnership(t *testing.T) {
+	api := &fakeConfigMaps{items: make(map[string]*corev1.ConfigMap)}
+	k8s := &configMapSink{configMaps: api, name: "rule-files", namespace: "monitoring", prometheus: "k8s"}
+	gpu := &configMapSink{configMaps: api, name: "rule-files", namespace: "monitoring", prometheus: "k8s-gpu"}
+
+	if err := k8s.Apply(ioutil.Discard, makeRule("k8s-app-rules", "monitoring", "k8s")); err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if err := gpu.Apply(ioutil.Discard, makeRule("k8s-gpu-node-rules", "monitoring", "k8s-gpu")); err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	loaded := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{makeRule("k8s-new-rules", "monitoring", "k8s")}}
+	if err := k8s.ApplyAll(ioutil.Discard, loaded, true); err != nil {
+		t.Fatalf("Unexpected error applying all rules, %s", err)
+	}
+	var keys []string
+	for key := range api.items["rule-files"].Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"k8s-gpu-node-rules.yaml", "k8s-new-rules.yaml"}) {
+		t.Errorf("Unexpected keys in the ConfigMap, %v", keys)
+	}
+	if names, err := gpu.List(); err != nil || !reflect.DeepEqual(names, []string{"k8s-gpu-node-rules"}) {
+		t.Errorf("Saw rules %v, %v for k8s-gpu", names, err)
+	}
+	if names, err := k8s.List(); err != nil || !reflect.DeepEqual(names, []string{"k8s-new-rules"}) {
+		t.Errorf("Saw rules %v, %v for k8s", names, err)
+	}
+}
+
+func TestWriteRuleFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifests")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rule := makeRule("prom-a-rules", "monitoring", "prom")
+	rule.Spec.Groups = []v1.RuleGroup{{Name: "a", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString("sum(up)")}}}}
+	rules := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{rule}}
+
+	written, err := writeConfigMapManifest(rules, dir, "prom-rule-files", "monitoring")
+	if err != nil || !reflect.DeepEqual(written, []string{"prom-rule-files.yaml"}) {
+		t.Fatalf("Saw files %v, %v", written, err)
+	}
+	manifest, _ := ioutil.ReadFile(filepath.Join(dir, "prom-rule-files.yaml"))
+	for _, want := range []string{"apiVersion: v1\n", "kind: ConfigMap\n", "  prom-a-rules.yaml: |\n", "namespace: monitoring\n"} {
+		if !strings.Contains(string(manifest), want) {
+			t.Errorf("ConfigMap manifest does not contain %q:\n%s", want, manifest)
+		}
+	}
+
+	// Switching format replaces the ConfigMap and kustomization.yaml
+	written, err = writeRuleFiles(rules, dir)
+	if err != nil || !reflect.DeepEqual(written, []string{"prom-a-rules.yaml"}) {
+		t.Fatalf("Saw files %v, %v", written, err)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 1 {
+		t.Errorf("Expected only the rule file, saw %v", names)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "prom-a-rules.yaml"))
+	var parsed rulefmt.RuleGroups
+	if err := yaml.UnmarshalStrict(data, &parsed); err != nil {
+		t.Fatalf("Failed to parse rule file, %s:\n%s", err, data)
+	}
+	if len(parsed.Groups) != 1 || parsed.Groups[0].Rules[0].Expr != "sum(up)" {
+		t.Errorf("Unexpected rule file:\n%s", data)
+	}
+}
+
+func TestReloadPrometheus(t *testing.T) {
+	cases := []struct {
+		status  int
+		success bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusForbidden, false},
+	}
+
+	for ix, td := range cases {
+		var seen string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Method + " " + r.URL.Path
+			w.WriteHeader(td.status)
+		}))
+		err := reloadPrometheus(server.URL + "/")
+		server.Close()
+
+		if (err == nil) != td.success {
+			t.Errorf("Case #%d, saw error %v, expected success %v", ix, err, td.success)
+		}
+		if seen != "POST /-/reload" {
+			t.Errorf("Case #%d, saw request %q", ix, seen)
+		}
+	}
+}
+
+func TestOutputDirReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rule := makeRule("k8s-node-rules", "monitoring", "k8s")
+	rule.Spec.Groups = []v1.RuleGroup{{Name: "a", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString("1")}}}}
+	rules := &v1.PrometheusRuleList{Items: []*v1.PrometheusRule{rule}}
+
+	cases := []struct {
+		format string
+		reload bool
+	}{
+		{prometheusRuleFormat, false},
+		{configMapFormat, false},
+		{ruleFilesFormat, true},
+	}
+
+	for ix, td := range cases {
+		reloaded := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reloaded = true
+		}))
+		opts := uploadOptions{
+			outputDir:    filepath.Join(dir, td.format),
+			outputFormat: td.format,
+			targets:      map[string]ruleTarget{"a": {Namespace: "monitoring", Prometheus: "k8s", PrometheusURL: server.URL}},
+		}
+		var out bytes.Buffer
+		_, err := uploadPrometheusRules(&out, "a", rules, nil, opts)
+		server.Close()
+
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error, %s", ix, err)
+		}
+		if reloaded != td.reload {
+			t.Errorf("Case #%d, saw reload %v, expected %v", ix, reloaded, td.reload)
+		}
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	rule := makeRule("k8s-node-rules", "monitoring", "k8s")
+	rule.Spec.Groups = []v1.RuleGroup{{Name: "a", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString("1")}}}}
+	rule.SetAnnotations(map[string]string{sourceFileAnnotation: "node.yaml"})
+	hash, err := contentHash(rule)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	p := provenance{gitCommit: "abc123", gitBranch: "main", version: "1.2.3", timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	annotated, err := p.annotate(rule)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	expected := map[string]string{
+		sourceFileAnnotation:  "node.yaml",
+		contentHashAnnotation: hash,
+		gitCommitAnnotation:   "abc123",
+		gitBranchAnnotation:   "main",
+		versionAnnotation:     "1.2.3",
+		appliedAtAnnotation:   "2020-01-02T03:04:05Z",
+	}
+	if !reflect.DeepEqual(annotated.GetAnnotations(), expected) {
+		t.Errorf("Saw annotations %v, expected %v", annotated.GetAnnotations(), expected)
+	}
+	if len(rule.GetAnnotations()) != 1 {
+		t.Errorf("Annotating modified the rule, %v", rule.GetAnnotations())
+	}
+	if seen, _ := contentHash(annotated); seen != hash {
+		t.Errorf("Provenance annotations changed the hash, saw %s, expected %s", seen, hash)
+	}
+	if !unchanged(annotated, annotated) {
+		t.Errorf("Expected the annotated rule to be unchanged from itself")
+	}
+	if unchanged(rule, annotated) {
+		t.Errorf("Expected a rule without a content hash to be changed")
+	}
+
+	changes := []func(*v1.PrometheusRule){
+		func(r *v1.PrometheusRule) { r.Spec.Groups[0].Rules[0].Expr = intstr.FromString("2") },
+		func(r *v1.PrometheusRule) { r.SetLabels(map[string]string{"team": "sre"}) },
+		func(r *v1.PrometheusRule) { r.GetAnnotations()[sourceFileAnnotation] = "other.yaml" },
+	}
+	for ix, change := range changes {
+		changed := rule.DeepCopy()
+		change(changed)
+		if seen, _ := contentHash(changed); seen == hash {
+			t.Errorf("Case #%d, expected the hash to change", ix)
+		}
+		// Edited by hand, keeping the recorded hash
+		edited := annotated.DeepCopy()
+		change(edited)
+		edited.GetAnnotations()[contentHashAnnotation] = hash
+		if unchanged(edited, annotated) {
+			t.Errorf("Case #%d, expected a rule edited in the cluster to be changed", ix)
+		}
+	}
+}
+
+func TestProvenanceSize(t *testing.T) {
+	p := provenance{gitCommit: strings.Repeat("a", 40), gitBranch: "main", version: "1.2.3", timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	for ix, annotations := range []map[string]string{nil, {sourceFileAnnotation: "node.yaml"}} {
+		rule := makeRule("k8s-node-rules", "monitoring", "k8s")
+		rule.SetAnnotations(annotations)
+		annotated, err := p.annotate(rule)
+		if err != nil {
+			t.Fatalf("Case #%d, unexpected error, %s", ix, err)
+		}
+		before, _ := cfgloader.ObjectSize(rule)
+		after, _ := cfgloader.ObjectSize(annotated)
+		if after-before > p.size() {
+			t.Errorf("Case #%d, annotating added %d bytes, more than the %d reserved", ix, after-before, p.size())
+		}
+	}
+
+	// A rule file that only fits the size limit before it is annotated
+	dir, err := ioutil.TempDir("", "provenance-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := "groups:\n- name: a\n  rules:\n  - record: a:b:c\n    expr: up\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	l := ruleTarget{Namespace: "monitoring", Prometheus: "k8s"}.loader()
+	rules, err := l.LoadDirectory(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	size, _ := cfgloader.ObjectSize(rules.Items[0])
+	annotated, _ := p.annotate(rules.Items[0])
+	if annotatedSize, _ := cfgloader.ObjectSize(annotated); annotatedSize <= size {
+		t.Fatalf("Annotating did not make the rule larger")
+	}
+	l.MaxObjectSize = size
+	l.Reserve = p.size()
+	if _, err := l.LoadDirectory(dir); err == nil {
+		t.Errorf("Expected an error for a rule that is too large once annotated")
+	}
+}
+
+func TestCRDSinkApply(t *testing.T) {
+	rule := makeRule("k8s-node-rules", "", "k8s")
+	rule.Spec.Groups = []v1.RuleGroup{{Name: "a", Rules: []v1.Rule{{Record: "a:b:c", Expr: intstr.FromString("1")}}}}
+	p := provenance{gitCommit: "abc123", version: "1.2.3"}
+	current, _ := p.annotate(rule)
+	current.SetNamespace("monitoring")
+	stale := current.DeepCopy()
+	stale.Spec.Groups[0].Rules[0].Expr = intstr.FromString("2")
+	unannotated := rule.DeepCopy()
+	unannotated.SetNamespace("monitoring")
+	// Labels and annotations added by others
+	foreign := current.DeepCopy()
+	foreign.GetAnnotations()["argocd.argoproj.io/tracking-id"] = "rules:monitoring.coreos.com/PrometheusRule:monitoring/k8s-node-rules"
+	foreign.GetLabels()["app.kubernetes.io/managed-by"] = "argocd"
+	// One of our labels, edited by hand
+	edited := current.DeepCopy()
+	edited.GetLabels()["prometheus"] = "other"
+
+	cases := []struct {
+		existing *v1.PrometheusRule
+		methods  []string
+	}{
+		{nil, []string{"GET", "PATCH"}},
+		{current, []string{"GET"}},
+		{stale, []string{"GET", "PATCH"}},
+		{unannotated, []string{"GET", "PATCH"}},
+		{foreign, []string{"GET"}},
+		{edited, []string{"GET", "PATCH"}},
+	}
+
+	for ix, td := range cases {
+		var methods []string
+		var patch v1.PrometheusRule
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			methods = append(methods, r.Method)
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == http.MethodGet && td.existing == nil:
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(metav1.Status{Status: metav1.StatusFailure, Code: http.StatusNotFound, Reason: metav1.StatusReasonNotFound})
+			case r.Method == http.MethodGet:
+				json.NewEncoder(w).Encode(td.existing)
+			default:
+				json.NewDecoder(r.Body).Decode(&patch)
+				json.NewEncoder(w).Encode(&patch)
+			}
+		}))
+		api, err := monitoringv1.NewForConfig(&rest.Config{Host: server.URL})
+		if err != nil {
+			t.Fatalf("Case #%d, failed to create client, %s", ix, err)
+		}
+
+		s := &crdSink{api: api, namespace: "monitoring", prometheus: "k8s", provenance: p}
+		err = s.Apply(ioutil.Discard, rule)
+		server.Close()
+
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error, %s", ix, err)
+		}
+		if !reflect.DeepEqual(methods, td.methods) {
+			t.Errorf("Case #%d, saw requests %v, expected %v", ix, methods, td.methods)
+		}
+		if len(methods) > 1 && !reflect.DeepEqual(patch.GetAnnotations(), current.GetAnnotations()) {
+			t.Errorf("Case #%d, applied annotations %v, expected %v", ix, patch.GetAnnotations(), current.GetAnnotations())
+		}
+	}
+	if rule.GetAnnotations() != nil {
+		t.Errorf("Applying modified the rule, %v", rule.GetAnnotations())
+	}
+}
+
+func TestGitHead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create %s, %s", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s, %s", path, err)
+		}
+	}
+	write("repo/.git/refs/heads/main", "1111111111111111111111111111111111111111\n")
+	write("repo/.git/packed-refs", "# pack-refs with: peeled fully-peeled sorted\n2222222222222222222222222222222222222222 refs/heads/release\n")
+	write("repo/rules/team/app.yaml", "groups: []\n")
+	write("worktree/.git", "gitdir: ../repo/.git/worktrees/wt\n")
+	write("repo/.git/worktrees/wt/HEAD", "ref: refs/heads/release\n")
+	write("repo/.git/worktrees/wt/commondir", "../..\n")
+	write("detached/.git/HEAD", "3333333333333333333333333333333333333333\n")
+	write("plain/rules.yaml", "groups: []\n")
+
+	cases := []struct {
+		head   string
+		dir    string
+		commit string
+		branch string
+	}{
+		{"ref: refs/heads/main\n", "repo/rules/team", "1111111111111111111111111111111111111111", "main"},
+		{"ref: refs/heads/release\n", "repo", "2222222222222222222222222222222222222222", "release"},
+		{"ref: refs/heads/new\n", "repo", "", "new"},
+		{"", "worktree", "2222222222222222222222222222222222222222", "release"},
+		{"", "detached", "3333333333333333333333333333333333333333", ""},
+	}
+
+	for ix, td := range cases {
+		if td.head != "" {
+			write("repo/.git/HEAD", td.head)
+		}
+		commit, branch, err := gitHead(filepath.Join(dir, filepath.FromSlash(td.dir)))
+		if err != nil || commit != td.commit || branch != td.branch {
+			t.Errorf("Case #%d, saw %q, %q, %v, expected %q, %q", ix, commit, branch, err, td.commit, td.branch)
+		}
+	}
+
+	// Outside any repository, as long as the temporary directory is
+	// not in one itself
+	if gitDir, _ := findGitDir(dir); gitDir == "" {
+		commit, branch, err := gitHead(filepath.Join(dir, "plain"))
+		if err != nil || commit != "" || branch != "" {
+			t.Errorf("Expected nothing outside a repository, saw %q, %q, %v", commit, branch, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Name of the kustomization file generated in each output directory.
+const kustomizationFile = "kustomization.yaml"
+
+// kustomization is the minimal kustomize configuration listing the
+// generated manifests.
+type kustomization struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Resources  []string `json:"resources"`
+}
+
+// writeManifests writes one YAML manifest per PrometheusRule into dir,
+// creating it if needed, together with a kustomization.yaml listing
+// them. Any other YAML files in dir, left over from previous runs, are
+// removed. It returns the names of the files written.
+func writeManifests(rules *v1.PrometheusRuleList, dir string) ([]string, error) {
+	files := make(map[string][]byte)
+	for _, rule := range rules.Items {
+		manifest := normaliseRule(rule)
+		manifest.APIVersion = v1.SchemeGroupVersion.String()
+		manifest.Kind = v1.PrometheusRuleKind
+		buf, err := yaml.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		files[ruleFileName(rule.GetName())] = buf
+	}
+	return writeFiles(dir, files, true)
+}
+
+// writeConfigMapManifest writes a single ConfigMap manifest into dir,
+// holding every PrometheusRule as a rule file, together with a
+// kustomization.yaml listing it. Like writeManifests, it removes other
+// YAML files from dir.
+func writeConfigMapManifest(rules *v1.PrometheusRuleList, dir, name, namespace string) ([]string, error) {
+	data, err := ruleFiles(rules)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfigMapSize(name, data); err != nil {
+		return nil, err
+	}
+	buf, err := yaml.Marshal(newConfigMap(name, namespace, data))
+	if err != nil {
+		return nil, err
+	}
+	return writeFiles(dir, map[string][]byte{name + ".yaml": buf}, true)
+}
+
+// writeRuleFiles writes every PrometheusRule into dir as a plain rule
+// file, for prometheus' rule_files. Like writeManifests, it removes
+// other YAML files from dir.
+func writeRuleFiles(rules *v1.PrometheusRuleList, dir string) ([]string, error) {
+	data, err := ruleFiles(rules)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for name, content := range data {
+		files[name] = []byte(content)
+	}
+	return writeFiles(dir, files, false)
+}
+
+// writeFiles writes files into dir, creating it if needed, optionally
+// with a kustomization.yaml listing them, then removes any other YAML
+// files. It returns the names of the files written, sorted.
+func writeFiles(dir string, files map[string][]byte, kustomize bool) ([]string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	var written []string
+	for name := range files {
+		written = append(written, name)
+	}
+	sort.Strings(written)
+	for _, name := range written {
+		err = ioutil.WriteFile(filepath.Join(dir, name), files[name], 0644)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	keep := written
+	if kustomize {
+		buf, err := yaml.Marshal(kustomization{
+			APIVersion: "kustomize.config.k8s.io/v1beta1",
+			Kind:       "Kustomization",
+			Resources:  written,
+		})
+		if err != nil {
+			return written, err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, kustomizationFile), buf, 0644)
+		if err != nil {
+			return written, err
+		}
+		keep = append([]string{kustomizationFile}, written...)
+	}
+
+	return written, removeStaleManifests(dir, keep)
+}
+
+// removeStaleManifests deletes all YAML files in dir that are not in
+// keep.
+func removeStaleManifests(dir string, keep []string) error {
+	wanted := make(map[string]bool)
+	for _, name := range keep {
+		wanted[name] = true
+	}
+
+	existing, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	for _, path := range existing {
+		if wanted[filepath.Base(path)] {
+			continue
+		}
+		err := os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("failed to remove stale manifest %s: %s", path, err)
+		}
+	}
+
+	return nil
+}
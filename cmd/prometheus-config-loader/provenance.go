@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+// version is the version of the loader, recorded on the PrometheusRules
+// it uploads. Set it when building, with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// The annotations recording where an uploaded PrometheusRule came from.
+// All but the source file change without the rule itself changing, so
+// they are not part of the content hash, nor shown in diffs.
+const (
+	provenancePrefix      = "prometheus-config-loader/"
+	sourceFileAnnotation  = provenancePrefix + "source-file"
+	contentHashAnnotation = provenancePrefix + "content-hash"
+	gitCommitAnnotation   = provenancePrefix + "git-commit"
+	gitBranchAnnotation   = provenancePrefix + "git-branch"
+	versionAnnotation     = provenancePrefix + "version"
+	appliedAtAnnotation   = provenancePrefix + "applied-at"
+)
+
+// volatileAnnotations are the provenance annotations that are left out
+// of the content hash and of diffs.
+var volatileAnnotations = []string{
+	contentHashAnnotation,
+	gitCommitAnnotation,
+	gitBranchAnnotation,
+	versionAnnotation,
+	appliedAtAnnotation,
+}
+
+// provenance is what is recorded on every PrometheusRule uploaded in a
+// run, besides its source file and content hash.
+type provenance struct {
+	gitCommit string
+	gitBranch string
+	version   string
+	timestamp time.Time
+}
+
+// loadProvenance works out the provenance for rules loaded from the
+// source directory dir, at time now. If the git repository can not be
+// read, the rest of the provenance is still returned.
+func loadProvenance(dir string, now time.Time) (provenance, error) {
+	rv := provenance{version: version, timestamp: now.UTC()}
+	var err error
+	rv.gitCommit, rv.gitBranch, err = gitHead(dir)
+	return rv, err
+}
+
+// annotate returns a copy of rule with the content hash and the
+// provenance annotations added.
+func (p provenance) annotate(rule *v1.PrometheusRule) (*v1.PrometheusRule, error) {
+	hash, err := contentHash(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := rule.DeepCopy()
+	annotations := rv.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	for key, val := range p.annotations(hash) {
+		annotations[key] = val
+	}
+	rv.SetAnnotations(annotations)
+	return rv, nil
+}
+
+// annotations returns the annotations annotate adds, given the content
+// hash. Empty values are left out.
+func (p provenance) annotations(hash string) map[string]string {
+	appliedAt := ""
+	if !p.timestamp.IsZero() {
+		appliedAt = p.timestamp.Format(time.RFC3339)
+	}
+	rv := make(map[string]string)
+	for key, val := range map[string]string{
+		contentHashAnnotation: hash,
+		gitCommitAnnotation:   p.gitCommit,
+		gitBranchAnnotation:   p.gitBranch,
+		versionAnnotation:     p.version,
+		appliedAtAnnotation:   appliedAt,
+	} {
+		if val != "" {
+			rv[key] = val
+		}
+	}
+	return rv
+}
+
+// size returns the most annotate can add to the size of a
+// PrometheusRule, serialized as JSON, so the loader can keep that much
+// room below the size limit, see cfgloader.Loader.Reserve.
+func (p provenance) size() int {
+	// Room for the annotations themselves, if the rule has none yet
+	rv := len(`"annotations":{},`)
+	hash := "sha256:" + strings.Repeat("0", sha256.Size*2)
+	for key, val := range p.annotations(hash) {
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(val)
+		// The colon and the comma
+		rv += len(k) + len(v) + 2
+	}
+	return rv
+}
+
+// contentHash returns a hash of everything in a PrometheusRule that we
+// set, other than the volatile provenance annotations: the spec, the
+// labels and the other annotations. For a rule found in the cluster,
+// only hash what we set, see ownContent.
+func contentHash(rule *v1.PrometheusRule) (string, error) {
+	annotations := make(map[string]string)
+	for key, val := range rule.GetAnnotations() {
+		annotations[key] = val
+	}
+	for _, key := range append(volatileAnnotations, ignoredAnnotations...) {
+		delete(annotations, key)
+	}
+
+	// encoding/json sorts map keys, so equal content always gives
+	// the same hash.
+	buf, err := json.Marshal(struct {
+		Spec        v1.PrometheusRuleSpec `json:"spec"`
+		Labels      map[string]string     `json:"labels,omitempty"`
+		Annotations map[string]string     `json:"annotations,omitempty"`
+	}{rule.Spec, rule.GetLabels(), annotations})
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %s", rule.GetName(), err)
+	}
+	sum := sha256.Sum256(buf)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// unchanged reports whether existing, as found in the cluster, already
+// has the content of rule, which has been annotated. Both the recorded
+// content hash and the actual content have to match, so objects edited
+// by hand are still updated. Labels and annotations that others have
+// added to existing, which server-side apply leaves alone, are
+// ignored.
+func unchanged(existing, rule *v1.PrometheusRule) bool {
+	hash := rule.GetAnnotations()[contentHashAnnotation]
+	if hash == "" || existing.GetAnnotations()[contentHashAnnotation] != hash {
+		return false
+	}
+	seen, err := contentHash(ownContent(existing, rule))
+	return err == nil && seen == hash
+}
+
+// ownContent returns a copy of existing with only the labels and
+// annotations that rule sets. If we stop setting one, the content hash
+// of rule changes, so it is still updated.
+func ownContent(existing, rule *v1.PrometheusRule) *v1.PrometheusRule {
+	rv := existing.DeepCopy()
+	rv.SetLabels(pickKeys(existing.GetLabels(), rule.GetLabels()))
+	rv.SetAnnotations(pickKeys(existing.GetAnnotations(), rule.GetAnnotations()))
+	return rv
+}
+
+// pickKeys returns the entries of m whose keys are also in keys.
+func pickKeys(m, keys map[string]string) map[string]string {
+	rv := make(map[string]string)
+	for key := range keys {
+		if val, ok := m[key]; ok {
+			rv[key] = val
+		}
+	}
+	return rv
+}
+
+// gitHead returns the commit checked out in the git repository holding
+// dir, and its branch, read straight from the repository. The branch
+// is empty for a detached HEAD, both are empty if dir is not in a git
+// repository.
+func gitHead(dir string) (string, string, error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil || gitDir == "" {
+		return "", "", err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+	head := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(head, "ref: ") {
+		return head, "", nil
+	}
+	ref := strings.TrimPrefix(head, "ref: ")
+	commit, err := resolveGitRef(gitDir, ref)
+	return commit, strings.TrimPrefix(ref, "refs/heads/"), err
+}
+
+// findGitDir returns the git directory of the repository holding dir,
+// or the empty string if there is none. A .git file, as used for
+// worktrees and submodules, points to the git directory.
+func findGitDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		candidate := filepath.Join(dir, ".git")
+		info, err := os.Stat(candidate)
+		if err == nil && info.IsDir() {
+			return candidate, nil
+		}
+		if err == nil {
+			data, err := ioutil.ReadFile(candidate)
+			if err != nil {
+				return "", err
+			}
+			line := strings.TrimSpace(string(data))
+			if !strings.HasPrefix(line, "gitdir: ") {
+				return "", fmt.Errorf("%s does not point to a git directory", candidate)
+			}
+			gitDir := strings.TrimPrefix(line, "gitdir: ")
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return gitDir, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// resolveGitRef returns the commit a ref points to, looking at the
+// loose refs, then the packed ones. Worktrees keep their refs in the
+// common git directory.
+func resolveGitRef(gitDir, ref string) (string, error) {
+	dirs := []string{gitDir}
+	if data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(gitDir, common)
+		}
+		dirs = append(dirs, common)
+	}
+
+	for _, dir := range dirs {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+	}
+	for _, dir := range dirs {
+		f, err := os.Open(filepath.Join(dir, "packed-refs"))
+		if err != nil {
+			continue
+		}
+		commit, found := findPackedRef(f, ref)
+		f.Close()
+		if found {
+			return commit, nil
+		}
+	}
+	// A branch without any commits yet
+	return "", nil
+}
+
+// findPackedRef looks a ref up in the contents of a packed-refs file,
+// returning the commit it points to and whether it was found.
+func findPackedRef(r io.Reader, ref string) (string, bool) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == ref {
+			return fields[0], true
+		}
+	}
+	return "", false
+}
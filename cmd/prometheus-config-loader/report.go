@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/G-Research/prometheus-config-loader/promtool"
+)
+
+// Names of the phases a checkResult can come from.
+const (
+	syntaxPhase   = "syntax"
+	lintPhase     = "lint"
+	unitTestPhase = "unit-test"
+)
+
+// checkResult is the outcome of syntax-checking or unit-testing a
+// single file, for a single context.
+type checkResult struct {
+	Phase    string        `json:"phase"`
+	Context  string        `json:"context"`
+	File     string        `json:"file"`
+	Passed   bool          `json:"passed"`
+	Duration time.Duration `json:"duration"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// newCheckResult builds a checkResult from what a Checker or promtool
+// returned. The output of promtool is taken from the error, if it
+// failed.
+func newCheckResult(phase, context, file string, start time.Time, out string, err error) checkResult {
+	rv := checkResult{
+		Phase:    phase,
+		Context:  context,
+		File:     file,
+		Passed:   err == nil,
+		Duration: time.Since(start),
+		Stdout:   out,
+	}
+	if pErr, ok := err.(promtool.PromtoolError); ok {
+		rv.Stdout = pErr.Stdout
+		rv.Stderr = pErr.Stderr
+		rv.Error = fmt.Sprint(pErr.OriginalError)
+	} else if err != nil {
+		rv.Error = err.Error()
+	}
+	return rv
+}
+
+// countFailures returns the number of failed checks.
+func countFailures(results []checkResult) int {
+	rv := 0
+	for _, result := range results {
+		if !result.Passed {
+			rv++
+		}
+	}
+	return rv
+}
+
+// junitTestSuites and the types below it are the parts of the JUnit
+// XML format understood by most CI systems.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// seconds formats a duration the way JUnit expects it.
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the results as JUnit XML, with one test suite per
+// phase and context, in the order they first occur in results.
+func writeJUnit(w io.Writer, results []checkResult) error {
+	var report junitTestSuites
+	index := make(map[string]int)
+	durations := make(map[string]time.Duration)
+
+	for _, result := range results {
+		name := result.Phase + "/" + result.Context
+		ix, ok := index[name]
+		if !ok {
+			ix = len(report.Suites)
+			index[name] = ix
+			report.Suites = append(report.Suites, junitTestSuite{Name: name})
+		}
+		suite := &report.Suites[ix]
+
+		tc := junitTestCase{
+			Name:      result.File,
+			ClassName: result.Context,
+			Time:      seconds(result.Duration),
+			SystemOut: result.Stdout,
+			SystemErr: result.Stderr,
+		}
+		if !result.Passed {
+			tc.Failure = &junitFailure{Message: result.Error, Body: result.Stdout + result.Stderr}
+			suite.Failures++
+		}
+		suite.Tests++
+		durations[name] += result.Duration
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for name, ix := range index {
+		report.Suites[ix].Time = seconds(durations[name])
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeJSON writes the results as a JSON list.
+func writeJSON(w io.Writer, results []checkResult) error {
+	if results == nil {
+		results = []checkResult{}
+	}
+	buf, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(buf))
+	return err
+}
+
+// writeReportFile creates the named file and writes a report to it.
+func writeReportFile(name string, results []checkResult, write func(io.Writer, []checkResult) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = write(f, results)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write report %s: %s", name, err)
+	}
+	return nil
+}
+
+// writeReports writes the JUnit XML and JSON reports, for each of the
+// file names that is not empty.
+func writeReports(results []checkResult, junitFile, jsonFile string) error {
+	if junitFile != "" {
+		if err := writeReportFile(junitFile, results, writeJUnit); err != nil {
+			return err
+		}
+	}
+	if jsonFile != "" {
+		if err := writeReportFile(jsonFile, results, writeJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
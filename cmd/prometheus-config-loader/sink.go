@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	monitoringv1 "github.com/coreos/prometheus-operator/pkg/client/versioned"
+	yaml "gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader"
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+	"github.com/G-Research/prometheus-config-loader/ruler"
+)
+
+// sink is somewhere the rules for a context are uploaded to. Rules are
+// identified by the name of their PrometheusRule.
+type sink interface {
+	// String describes where the rules go, for logging.
+	String() string
+	// Existing returns the version of a rule currently in the sink,
+	// rendered as by Render, and whether there is one.
+	Existing(name string) (string, bool, error)
+	// Render renders a rule the way the sink stores it, for diffs.
+	Render(rule *v1.PrometheusRule) (string, error)
+	// Apply creates or updates a rule. Anything meant for the user
+	// is written to out.
+	Apply(out io.Writer, rule *v1.PrometheusRule) error
+	// List returns the names of all rules in the sink that were
+	// created for our prometheus.
+	List() ([]string, error)
+	// Delete deletes a rule.
+	Delete(name string) error
+}
+
+// rulerAuth holds the credentials for ruler APIs, shared by all
+// contexts.
+type rulerAuth struct {
+	username    string
+	password    string
+	bearerToken string
+}
+
+// loadRulerAuth reads the ruler credentials from files. Empty file
+// names are skipped.
+func loadRulerAuth(username, passwordFile, tokenFile string) (rulerAuth, error) {
+	rv := rulerAuth{username: username}
+	for _, secret := range []struct {
+		file string
+		dest *string
+	}{
+		{passwordFile, &rv.password},
+		{tokenFile, &rv.bearerToken},
+	} {
+		if secret.file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(secret.file)
+		if err != nil {
+			return rv, err
+		}
+		*secret.dest = strings.TrimSpace(string(data))
+	}
+	return rv, nil
+}
+
+// newSink returns the sink for a context: the ruler API if the context
+// has a ruler URL, otherwise a ConfigMap or PrometheusRule objects in
+// the cluster, depending on the output format.
+func newSink(c *clientapi.Config, context string, target ruleTarget, opts uploadOptions) (sink, error) {
+	if target.RulerURL != "" {
+		client := &ruler.Client{
+			URL:         target.RulerURL,
+			TenantID:    target.Tenant,
+			Username:    opts.rulerAuth.username,
+			Password:    opts.rulerAuth.password,
+			BearerToken: opts.rulerAuth.bearerToken,
+		}
+		return &rulerSink{client: client, prometheus: target.Prometheus}, nil
+	}
+
+	if opts.outputFormat == configMapFormat {
+		core, err := newCoreClient(c, context)
+		if err != nil {
+			return nil, err
+		}
+		return &configMapSink{
+			configMaps: core.ConfigMaps(target.Namespace),
+			name:       configMapName(opts.configMapName, target),
+			namespace:  target.Namespace,
+			prometheus: target.Prometheus,
+		}, nil
+	}
+
+	api, err := newMonitoringClient(c, context)
+	if err != nil {
+		return nil, err
+	}
+	return &crdSink{
+		api:            api,
+		namespace:      target.Namespace,
+		prometheus:     target.Prometheus,
+		forceConflicts: opts.forceConflicts,
+		provenance:     opts.provenance,
+	}, nil
+}
+
+// batchSink is a sink that can apply all rules for a context in one
+// go, rather than one at a time.
+type batchSink interface {
+	sink
+	// ApplyAll creates or updates all rules, deleting stale ones if
+	// prune is set.
+	ApplyAll(out io.Writer, rules *v1.PrometheusRuleList, prune bool) error
+}
+
+// crdSink stores rules as PrometheusRule objects, for prometheus-operator.
+// Every rule applied is annotated with its provenance.
+type crdSink struct {
+	api            monitoringv1.Interface
+	namespace      string
+	prometheus     string
+	forceConflicts bool
+	provenance     provenance
+}
+
+func (s *crdSink) String() string {
+	return "namespace " + s.namespace
+}
+
+func (s *crdSink) Existing(name string) (string, bool, error) {
+	existing, err := s.api.MonitoringV1().PrometheusRules(s.namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	rv, err := renderRule(existing)
+	return rv, true, err
+}
+
+func (s *crdSink) Render(rule *v1.PrometheusRule) (string, error) {
+	return renderRule(rule)
+}
+
+// Apply skips rules whose content has not changed since they were last
+// applied, going by their content hash.
+func (s *crdSink) Apply(out io.Writer, rule *v1.PrometheusRule) error {
+	rule, err := s.provenance.annotate(rule)
+	if err != nil {
+		return err
+	}
+	existing, err := s.api.MonitoringV1().PrometheusRules(s.namespace).Get(rule.GetName(), metav1.GetOptions{})
+	if err == nil && unchanged(existing, rule) {
+		log.Printf("INFO: rule %s is unchanged, skipping", rule.GetName())
+		return nil
+	}
+	return applyRule(out, s.api, s.namespace, rule, s.forceConflicts)
+}
+
+func (s *crdSink) List() ([]string, error) {
+	existing, err := s.api.MonitoringV1().PrometheusRules(s.namespace).List(metav1.ListOptions{LabelSelector: cfgloader.RuleSelector(s.prometheus)})
+	if err != nil {
+		return nil, err
+	}
+	var rv []string
+	for _, rule := range existing.Items {
+		rv = append(rv, rule.GetName())
+	}
+	return rv, nil
+}
+
+func (s *crdSink) Delete(name string) error {
+	return s.api.MonitoringV1().PrometheusRules(s.namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+// ownersNamespace is the ruler namespace recording which namespaces
+// were uploaded for which prometheus, as the rules API has nowhere to
+// keep that with the namespaces themselves. It holds an empty group
+// for every namespace, named by ownerGroup.
+const ownersNamespace = "prometheus-config-loader"
+
+// ownerGroup is the name of the group recording that a namespace was
+// uploaded for a prometheus. Prometheus names have no slashes, so no
+// other prometheus can claim it.
+func ownerGroup(prometheus, namespace string) string {
+	return prometheus + "/" + namespace
+}
+
+// rulerSink stores rules through the rules API of a ruler, such as
+// Cortex or Mimir. Every PrometheusRule becomes a ruler namespace of
+// the same name, holding its groups.
+type rulerSink struct {
+	client     *ruler.Client
+	prometheus string
+}
+
+func (s *rulerSink) String() string {
+	return fmt.Sprintf("ruler %s, tenant %s", s.client.URL, s.client.TenantID)
+}
+
+func (s *rulerSink) Existing(name string) (string, bool, error) {
+	groups, err := s.client.Get(name)
+	if err != nil || len(groups) == 0 {
+		return "", false, err
+	}
+	rv, err := renderGroups(groups)
+	return rv, true, err
+}
+
+func (s *rulerSink) Render(rule *v1.PrometheusRule) (string, error) {
+	return renderRuleFile(rule)
+}
+
+// Apply sets every group of the rule, then deletes any other groups
+// left in its namespace, and records the namespace as ours.
+func (s *rulerSink) Apply(out io.Writer, rule *v1.PrometheusRule) error {
+	if rule.GetName() == ownersNamespace {
+		return fmt.Errorf("rules can not be named %s, it is kept for our own use", ownersNamespace)
+	}
+	groups, err := cfgloader.RuleGroupsFromRule(rule)
+	if err != nil {
+		return err
+	}
+	existing, err := s.client.Get(rule.GetName())
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %s", rule.GetName(), err)
+	}
+
+	wanted := make(map[string]bool)
+	for _, g := range groups.Groups {
+		wanted[g.Name] = true
+		if err := s.client.SetGroup(rule.GetName(), g); err != nil {
+			return fmt.Errorf("failed to set group %s in %s: %s", g.Name, rule.GetName(), err)
+		}
+	}
+	for _, g := range existing {
+		if !wanted[g.Name] {
+			if err := s.client.DeleteGroup(rule.GetName(), g.Name); err != nil {
+				return fmt.Errorf("failed to delete group %s from %s: %s", g.Name, rule.GetName(), err)
+			}
+		}
+	}
+	owner := rulefmt.RuleGroup{Name: ownerGroup(s.prometheus, rule.GetName())}
+	if err := s.client.SetGroup(ownersNamespace, owner); err != nil {
+		return fmt.Errorf("failed to record %s in %s: %s", rule.GetName(), ownersNamespace, err)
+	}
+	return nil
+}
+
+// List returns the namespaces recorded as uploaded for our prometheus.
+func (s *rulerSink) List() ([]string, error) {
+	owners, err := s.client.Get(ownersNamespace)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ownerGroup(s.prometheus, "")
+	var rv []string
+	for _, g := range owners {
+		if strings.HasPrefix(g.Name, prefix) {
+			rv = append(rv, strings.TrimPrefix(g.Name, prefix))
+		}
+	}
+	return rv, nil
+}
+
+// Delete deletes a namespace, then its record. Namespaces someone else
+// already deleted only have their record deleted.
+func (s *rulerSink) Delete(name string) error {
+	if err := s.client.DeleteNamespace(name); err != nil && !ruler.IsNotFound(err) {
+		return err
+	}
+	err := s.client.DeleteGroup(ownersNamespace, ownerGroup(s.prometheus, name))
+	if ruler.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// renderRuleFile renders a rule as a rule file, with the fields the
+// PrometheusRule CRD can not represent.
+func renderRuleFile(rule *v1.PrometheusRule) (string, error) {
+	groups, err := cfgloader.RuleGroupsFromRule(rule)
+	if err != nil {
+		return "", err
+	}
+	return renderGroups(groups.Groups)
+}
+
+// renderGroups renders rule groups as a rule file.
+func renderGroups(groups []rulefmt.RuleGroup) (string, error) {
+	buf, err := yaml.Marshal(rulefmt.RuleGroups{Groups: groups})
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	clientapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader"
+	"github.com/G-Research/prometheus-config-loader/templates"
+)
+
+// targetValue is the value, in the .vars files, holding the namespace
+// and prometheus for a context.
+const targetValue = "target"
+
+// The settings in targetValue holding the extra labels and annotations
+// for the PrometheusRules of a context.
+const (
+	targetLabels      = "labels"
+	targetAnnotations = "annotations"
+)
+
+// ruleTarget is where the rules for a context are uploaded to. With a
+// ruler URL, they go to the ruler API, as the tenant, rather than to
+// the namespace in the cluster. With a prometheus URL, that prometheus
+// is asked to reload its configuration once the rules are uploaded.
+// The PrometheusRules are named by the name template, with the extra
+// labels and annotations, see cfgloader.Loader.
+type ruleTarget struct {
+	Namespace     string
+	Prometheus    string
+	RulerURL      string
+	Tenant        string
+	PrometheusURL string
+	NameTemplate  string
+	Labels        map[string]string
+	Annotations   map[string]string
+}
+
+func (t ruleTarget) String() string {
+	if t.RulerURL != "" {
+		return fmt.Sprintf("ruler %s, tenant %s, prometheus %s", t.RulerURL, t.Tenant, t.Prometheus)
+	}
+	return fmt.Sprintf("namespace %s, prometheus %s", t.Namespace, t.Prometheus)
+}
+
+// loader returns the loader for the rules of the target.
+// Every rule is annotated with the file it was loaded from.
+func (t ruleTarget) loader() *cfgloader.Loader {
+	annotations := map[string]string{sourceFileAnnotation: "{{ .File }}"}
+	for key, val := range t.Annotations {
+		annotations[key] = val
+	}
+	return &cfgloader.Loader{
+		Namespace:    t.Namespace,
+		Prometheus:   t.Prometheus,
+		NameTemplate: t.NameTemplate,
+		Labels:       t.Labels,
+		Annotations:  annotations,
+	}
+}
+
+// resolveTargets works out the target for every context. Each setting
+// is taken from the first of these that sets it:
+//
+//   - the label of the same name for the context in the context
+//     manifest
+//   - target.<setting> in the context's values
+//   - the defaults, from the command line
+//
+// Except for the namespace, which defaultNamespaces fills in later,
+// as the namespace of the kubeconfig context comes before the default.
+//
+// The settings are namespace, prometheus, ruler_url, tenant,
+// prometheus_url and name_template. The labels and annotations are
+// maps in the values, target.labels and target.annotations, each of
+// which is merged over the defaults.
+func resolveTargets(contexts []string, tplData templates.ExpansionData, manifest *templates.Manifest, defaults ruleTarget) map[string]ruleTarget {
+	rv := make(map[string]ruleTarget)
+	for _, context := range contexts {
+		values, _ := tplData[context].Values.Values[targetValue].(map[string]interface{})
+		setting := func(name, fallback string) string {
+			s, _ := values[name].(string)
+			return firstNonEmpty(manifest.Label(context, name), s, fallback)
+		}
+
+		rv[context] = ruleTarget{
+			Namespace:     setting(templates.NamespaceLabel, defaults.Namespace),
+			Prometheus:    setting(templates.PrometheusLabel, defaults.Prometheus),
+			RulerURL:      setting(templates.RulerURLLabel, defaults.RulerURL),
+			Tenant:        setting(templates.TenantLabel, defaults.Tenant),
+			PrometheusURL: setting(templates.PrometheusURLLabel, defaults.PrometheusURL),
+			NameTemplate:  setting(templates.NameTemplateLabel, defaults.NameTemplate),
+			Labels:        mergeSettings(defaults.Labels, values[targetLabels]),
+			Annotations:   mergeSettings(defaults.Annotations, values[targetAnnotations]),
+		}
+	}
+	return rv
+}
+
+// kubeContexts returns the contexts whose rules go to a cluster,
+// rather than a ruler.
+func kubeContexts(targets map[string]ruleTarget, contexts []string) []string {
+	var rv []string
+	for _, context := range contexts {
+		if targets[context].RulerURL == "" {
+			rv = append(rv, context)
+		}
+	}
+	return rv
+}
+
+// defaultNamespaces sets the namespace of every context that has none
+// to the namespace of its kubeconfig context, if cfg is not nil and
+// that is set, or else to namespace.
+func defaultNamespaces(targets map[string]ruleTarget, cfg *clientapi.Config, namespace string) {
+	for context, target := range targets {
+		if target.Namespace != "" {
+			continue
+		}
+		if cfg != nil && cfg.Contexts[context] != nil {
+			target.Namespace = cfg.Contexts[context].Namespace
+		}
+		if target.Namespace == "" {
+			target.Namespace = namespace
+		}
+		targets[context] = target
+	}
+}
+
+// mergeSettings returns the defaults, overridden by the entries of
+// values, if it is a map. Values that are not strings are formatted
+// as with %v. It returns nil if neither has any entries.
+func mergeSettings(defaults map[string]string, values interface{}) map[string]string {
+	m, _ := values.(map[string]interface{})
+	if len(m) == 0 {
+		return defaults
+	}
+	rv := make(map[string]string)
+	for key, val := range defaults {
+		rv[key] = val
+	}
+	for key, val := range m {
+		rv[key] = fmt.Sprint(val)
+	}
+	return rv
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs,
+// as given on the command line.
+func parseKeyValues(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	rv := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		ix := strings.Index(pair, "=")
+		if ix < 1 {
+			return nil, fmt.Errorf("%q is not of the form key=value", pair)
+		}
+		rv[pair[:ix]] = pair[ix+1:]
+	}
+	return rv, nil
+}
+
+// firstNonEmpty returns the first of its arguments that is not empty.
+func firstNonEmpty(candidates ...string) string {
+	for _, s := range candidates {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/coreos/prometheus-operator/pkg/apis/monitoring/v1"
+	clientapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// uploadOptions collects the settings controlling what
+// uploadPrometheusRules does in each context.
+type uploadOptions struct {
+	dryRun         bool
+	showDiff       bool
+	prune          bool
+	outputDir      string
+	outputFormat   string
+	configMapName  string
+	targets        map[string]ruleTarget
+	forceConflicts bool
+	rulerAuth      rulerAuth
+	provenance     provenance
+	strict         bool
+	splitOversized bool
+}
+
+// uploadResult is the outcome of uploading to a single context.
+type uploadResult struct {
+	Context  string
+	Rules    int
+	Duration time.Duration
+	Err      error
+}
+
+// uploadAll calls uploadPrometheusRules for every context, running at
+// most parallelism of them at the same time. Output from each context
+// is buffered and written to stdout once that context is done, so it
+// does not get interleaved. The results are returned in the same order
+// as the contexts.
+func uploadAll(contexts []string, rules map[string]*v1.PrometheusRuleList, c *clientapi.Config, opts uploadOptions, parallelism int) []uploadResult {
+	results := make([]uploadResult, len(contexts))
+	jobs := make(chan int)
+	var outLock sync.Mutex
+	var wg sync.WaitGroup
+
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ix := range jobs {
+				var buf bytes.Buffer
+				start := time.Now()
+				count, err := uploadPrometheusRules(&buf, contexts[ix], rules[contexts[ix]], c, opts)
+				results[ix] = uploadResult{
+					Context:  contexts[ix],
+					Rules:    count,
+					Duration: time.Since(start),
+					Err:      err,
+				}
+
+				outLock.Lock()
+				io.Copy(os.Stdout, &buf)
+				outLock.Unlock()
+			}
+		}()
+	}
+
+	for ix := range contexts {
+		jobs <- ix
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// writeResults writes a table with the outcome for every context.
+func writeResults(out io.Writer, results []uploadResult) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTEXT\tSTATUS\tRULES\tDURATION\tERROR")
+	for _, result := range results {
+		status := "ok"
+		msg := ""
+		if result.Err != nil {
+			status = "FAILED"
+			msg = result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", result.Context, status, result.Rules, result.Duration.Round(time.Millisecond), msg)
+	}
+	w.Flush()
+}
@@ -0,0 +1,219 @@
+// Package diff provides a minimal line-based unified diff, good enough
+// for reviewing changes to rendered PrometheusRule objects.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// op is a single step of an edit script, kind is one of ' ', '-' or
+// '+'.
+type op struct {
+	kind byte
+	text string
+}
+
+// splitLines splits a string into lines, dropping the empty string
+// after a trailing newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// editScript computes the shortest edit script turning a into b, using
+// the linear space variant of Myers' O(ND) algorithm, so large inputs
+// that differ little are cheap. Within each run of changes, deletions
+// come before insertions.
+func editScript(a, b []string) []op {
+	s := &scripter{a: a, b: b}
+	s.compare(0, len(a), 0, len(b))
+
+	// Put the deletions of each run of changes first
+	rv := make([]op, 0, len(s.ops))
+	for ix := 0; ix < len(s.ops); {
+		if s.ops[ix].kind == ' ' {
+			rv = append(rv, s.ops[ix])
+			ix++
+			continue
+		}
+		end := ix
+		for end < len(s.ops) && s.ops[end].kind != ' ' {
+			end++
+		}
+		for _, kind := range []byte{'-', '+'} {
+			for _, o := range s.ops[ix:end] {
+				if o.kind == kind {
+					rv = append(rv, o)
+				}
+			}
+		}
+		ix = end
+	}
+	return rv
+}
+
+// scripter builds the edit script turning a into b.
+type scripter struct {
+	a, b []string
+	ops  []op
+}
+
+// compare appends the edit script turning a[aLo:aHi] into b[bLo:bHi].
+func (s *scripter) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && s.a[aLo] == s.b[bLo] {
+		s.ops = append(s.ops, op{' ', s.a[aLo]})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && s.a[aHi-suffix-1] == s.b[bHi-suffix-1] {
+		suffix++
+	}
+	aHi -= suffix
+	bHi -= suffix
+
+	switch {
+	case aLo == aHi:
+		for _, line := range s.b[bLo:bHi] {
+			s.ops = append(s.ops, op{'+', line})
+		}
+	case bLo == bHi:
+		for _, line := range s.a[aLo:aHi] {
+			s.ops = append(s.ops, op{'-', line})
+		}
+	default:
+		x, y, u, v := s.middleSnake(aLo, aHi, bLo, bHi)
+		s.compare(aLo, aLo+x, bLo, bLo+y)
+		for _, line := range s.a[aLo+x : aLo+u] {
+			s.ops = append(s.ops, op{' ', line})
+		}
+		s.compare(aLo+u, aHi, bLo+v, bHi)
+	}
+
+	for _, line := range s.a[aHi : aHi+suffix] {
+		s.ops = append(s.ops, op{' ', line})
+	}
+}
+
+// middleSnake finds the snake, running from (x, y) to (u, v) relative
+// to (aLo, bLo), in the middle of a shortest edit script turning
+// a[aLo:aHi] into b[bLo:bHi], by searching from both ends at once. The
+// first and last lines of both must differ, so the script has at least
+// two edits, and both halves are smaller than the whole.
+func (s *scripter) middleSnake(aLo, aHi, bLo, bHi int) (int, int, int, int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	max := (n + m + 1) / 2
+	// The furthest x reached on each diagonal, searching forward
+	// from the start and backward from the end, offset by off.
+	off := max + 1
+	forward := make([]int, 2*max+3)
+	backward := make([]int, 2*max+3)
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[off+k-1] < forward[off+k+1]) {
+				x = forward[off+k+1]
+			} else {
+				x = forward[off+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && s.a[aLo+x] == s.b[bLo+y] {
+				x++
+				y++
+			}
+			forward[off+k] = x
+			if kr := delta - k; odd && kr >= -(d-1) && kr <= d-1 && x+backward[off+kr] >= n {
+				return x0, y0, x, y
+			}
+		}
+		for kr := -d; kr <= d; kr += 2 {
+			var xr int
+			if kr == -d || (kr != d && backward[off+kr-1] < backward[off+kr+1]) {
+				xr = backward[off+kr+1]
+			} else {
+				xr = backward[off+kr-1] + 1
+			}
+			yr := xr - kr
+			xr0, yr0 := xr, yr
+			for xr < n && yr < m && s.a[aHi-xr-1] == s.b[bHi-yr-1] {
+				xr++
+				yr++
+			}
+			backward[off+kr] = xr
+			if k := delta - kr; !odd && k >= -d && k <= d && forward[off+k]+xr >= n {
+				return n - xr, m - yr, n - xr0, m - yr0
+			}
+		}
+	}
+	// Not reached, the searches always meet by then
+	return 0, 0, n, m
+}
+
+// hunkRange formats one side of a hunk header.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// Unified returns a unified diff turning a into b, with the given
+// number of context lines around each change. The names are used for
+// the "---" and "+++" header lines. If a and b are identical, the
+// empty string is returned.
+func Unified(aName, bName, a, b string, context int) string {
+	ops := editScript(splitLines(a), splitLines(b))
+
+	// Line offsets into a and b before each op.
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	var changes []int
+	for ix, o := range ops {
+		aPos[ix+1], bPos[ix+1] = aPos[ix], bPos[ix]
+		if o.kind != '+' {
+			aPos[ix+1]++
+		}
+		if o.kind != '-' {
+			bPos[ix+1]++
+		}
+		if o.kind != ' ' {
+			changes = append(changes, ix)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+
+	for ix := 0; ix < len(changes); {
+		start := changes[ix] - context
+		if start < 0 {
+			start = 0
+		}
+		end := changes[ix] + context + 1
+		ix++
+		for ix < len(changes) && changes[ix]-context <= end {
+			end = changes[ix] + context + 1
+			ix++
+		}
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aPos[start], aPos[end]-aPos[start]), hunkRange(bPos[start], bPos[end]-bPos[start]))
+		for _, o := range ops[start:end] {
+			fmt.Fprintf(&sb, "%c%s\n", o.kind, o.text)
+		}
+	}
+
+	return sb.String()
+}
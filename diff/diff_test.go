@@ -0,0 +1,119 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected string
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", ""},
+		{"", "", ""},
+		{
+			"", "a\nb\n",
+			"--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			"a\nb\n", "",
+			"--- old\n+++ new\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			"a\nb\nc\n", "a\nx\nc\n",
+			"--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n",
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\n5\n6\n7\n8\nnine\n",
+			"--- old\n+++ new\n@@ -8,2 +8,2 @@\n 8\n-9\n+nine\n",
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "one\n2\n3\n4\n5\n6\n7\n8\nnine\n",
+			"--- old\n+++ new\n@@ -1,2 +1,2 @@\n-1\n+one\n 2\n@@ -8,2 +8,2 @@\n 8\n-9\n+nine\n",
+		},
+		{
+			"1\n2\n3\n4\n", "one\n2\n3\nfour\n",
+			"--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n-4\n+four\n",
+		},
+	}
+
+	for ix, td := range cases {
+		seen := Unified("old", "new", td.a, td.b, 1)
+		if seen != td.expected {
+			t.Errorf("Case #%d, saw:\n%s\nexpected:\n%s", ix, seen, td.expected)
+		}
+	}
+}
+
+// lcsLength returns the length of the longest common subsequence of a
+// and b, the slow way.
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] >= cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestEditScript(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for ix := 0; ix < 500; ix++ {
+		var a, b []string
+		for n := r.Intn(12); n > 0; n-- {
+			a = append(a, string(rune('a'+r.Intn(4))))
+		}
+		for n := r.Intn(12); n > 0; n-- {
+			b = append(b, string(rune('a'+r.Intn(4))))
+		}
+
+		var seenA, seenB []string
+		edits := 0
+		for _, o := range editScript(a, b) {
+			if o.kind != '+' {
+				seenA = append(seenA, o.text)
+			}
+			if o.kind != '-' {
+				seenB = append(seenB, o.text)
+			}
+			if o.kind != ' ' {
+				edits++
+			}
+		}
+		if strings.Join(seenA, "") != strings.Join(a, "") || strings.Join(seenB, "") != strings.Join(b, "") {
+			t.Errorf("Case #%d, edit script does not turn %v into %v", ix, a, b)
+		}
+		if expected := len(a) + len(b) - 2*lcsLength(a, b); edits != expected {
+			t.Errorf("Case #%d, %v to %v took %d edits, expected %d", ix, a, b, edits, expected)
+		}
+	}
+}
+
+func TestUnifiedLarge(t *testing.T) {
+	var a, b []string
+	for ix := 0; ix < 20000; ix++ {
+		a = append(a, fmt.Sprintf("line %d", ix))
+		b = append(b, fmt.Sprintf("line %d", ix))
+	}
+	b[10000] = "changed"
+
+	expected := "--- old\n+++ new\n@@ -10000,3 +10000,3 @@\n line 9999\n-line 10000\n+changed\n line 10001\n"
+	seen := Unified("old", "new", strings.Join(a, "\n"), strings.Join(b, "\n"), 1)
+	if seen != expected {
+		t.Errorf("Saw:\n%s\nexpected:\n%s", seen, expected)
+	}
+}
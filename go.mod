@@ -1,22 +1,26 @@
 module github.com/G-Research/prometheus-config-loader
 
+go 1.16
+
 require (
 	github.com/coreos/prometheus-operator v0.29.0
+	github.com/prometheus/common v0.3.0
+	github.com/prometheus/prometheus v1.8.2-0.20190424153033-d3245f150225
+	gopkg.in/yaml.v2 v2.2.2
+	gopkg.in/yaml.v3 v3.0.1
+	k8s.io/api v0.0.0-20190111032252-67edc246be36
+	k8s.io/apimachinery v0.0.0-20181127025237-2b1284ed4c93
+	k8s.io/client-go v10.0.0+incompatible
+	sigs.k8s.io/yaml v1.1.0
+)
+
+require (
 	github.com/go-openapi/spec v0.19.0 // indirect
-	github.com/gogo/protobuf v1.2.1 // indirect
 	github.com/google/btree v1.0.0 // indirect
 	github.com/gregjones/httpcache v0.0.0-20190212212710-3befbb6ad0cc // indirect
-	github.com/hashicorp/golang-lru v0.5.1 // indirect
 	github.com/imdario/mergo v0.3.7 // indirect
 	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2 // indirect
 	golang.org/x/oauth2 v0.0.0-20190402181905-9f3314589c9a // indirect
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
-	gopkg.in/inf.v0 v0.9.1 // indirect
-	gopkg.in/yaml.v2 v2.2.2
-	k8s.io/api v0.0.0-20190111032252-67edc246be36 // indirect
-	k8s.io/apimachinery v0.0.0-20181127025237-2b1284ed4c93
-	k8s.io/client-go v10.0.0+incompatible
 	k8s.io/kube-openapi v0.0.0-20190418160015-6b3d3b2d5666 // indirect
-	sigs.k8s.io/yaml v1.1.0 // indirect
 )
@@ -0,0 +1,347 @@
+// Package importer turns the rules found in one or more clusters back
+// into a source directory. Values that differ between the clusters are
+// factored out into per-context variables, with a single templated
+// rule file shared by all of them.
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+)
+
+// Source is the rules read from a single context, keyed by the name of
+// the rule file (without the .yaml suffix) they should be written to.
+type Source map[string]rulefmt.RuleGroups
+
+// Result is a source directory built from one or more Sources.
+type Result struct {
+	// Contents of the rule files, keyed by file name
+	Files map[string][]byte
+	// Variables, keyed by context, or "default"
+	Values map[string]map[string]interface{}
+	// Human-readable descriptions of anything that could not be
+	// imported
+	Warnings []string
+}
+
+var nonIdentifier = regexp.MustCompile(`[^a-z0-9]+`)
+
+// factorer keeps track of the variables created while factoring.
+type factorer struct {
+	contexts []string
+	values   map[string]map[string]interface{}
+	names    map[string]bool
+}
+
+// Factor combines the sources for all contexts into a single source
+// directory. Rule files that exist in only some of the contexts can
+// not be represented, and are left out with a warning.
+//
+// Groups that have the same rules, with the same labels and
+// annotations, in every context are written once, with any field that
+// differs between the contexts replaced by a variable. The most common
+// value goes in default.vars, the others in <context>.vars. Any other
+// group is written once for each context it is found in, selected with
+// a template conditional on the context.
+func Factor(contexts []string, sources map[string]Source) (Result, error) {
+	rv := Result{
+		Files:  make(map[string][]byte),
+		Values: make(map[string]map[string]interface{}),
+	}
+	f := factorer{contexts: contexts, values: rv.Values, names: make(map[string]bool)}
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, context := range contexts {
+		for file := range sources[context] {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		var missing []string
+		perContext := make(map[string]rulefmt.RuleGroups)
+		for _, context := range contexts {
+			groups, ok := sources[context][file]
+			if !ok {
+				missing = append(missing, context)
+				continue
+			}
+			perContext[context] = groups
+		}
+		if len(missing) > 0 {
+			rv.Warnings = append(rv.Warnings, fmt.Sprintf("%s.yaml: skipped, it is missing in contexts %s", file, strings.Join(missing, ", ")))
+			continue
+		}
+
+		data, err := f.factorFile(file, perContext)
+		if err != nil {
+			return rv, fmt.Errorf("%s.yaml: %s", file, err)
+		}
+		rv.Files[file+".yaml"] = data
+	}
+
+	return rv, nil
+}
+
+// factorFile builds the templated contents of a single rule file.
+func (f *factorer) factorFile(file string, perContext map[string]rulefmt.RuleGroups) ([]byte, error) {
+	var names []string
+	byName := make(map[string]map[string]rulefmt.RuleGroup)
+	for _, context := range f.contexts {
+		for _, g := range perContext[context].Groups {
+			if byName[g.Name] == nil {
+				byName[g.Name] = make(map[string]rulefmt.RuleGroup)
+				names = append(names, g.Name)
+			}
+			byName[g.Name][context] = g
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("groups:\n")
+	for _, name := range names {
+		groups := byName[name]
+		if len(groups) == len(f.contexts) && f.sameShape(groups) {
+			out, err := f.factorGroup(file, groups)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(out)
+			continue
+		}
+		for _, context := range f.contexts {
+			g, ok := groups[context]
+			if !ok {
+				continue
+			}
+			out, err := yaml.Marshal([]rulefmt.RuleGroup{g})
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "<{[ if eq .Values.context %q ]}>\n", context)
+			buf.Write(out)
+			buf.WriteString("<{[ end ]}>\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// sameShape reports whether a group has the same rules, with the same
+// label and annotation names, in every context.
+func (f *factorer) sameShape(groups map[string]rulefmt.RuleGroup) bool {
+	first := groups[f.contexts[0]]
+	for _, context := range f.contexts[1:] {
+		g := groups[context]
+		if len(g.Rules) != len(first.Rules) {
+			return false
+		}
+		for ix, r := range g.Rules {
+			other := first.Rules[ix]
+			if (r.Record == "") != (other.Record == "") ||
+				(r.For == "") != (other.For == "") ||
+				(g.Interval == "") != (first.Interval == "") ||
+				!sameKeys(r.Labels, other.Labels) ||
+				!sameKeys(r.Annotations, other.Annotations) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sameKeys reports whether two maps have the same keys.
+func sameKeys(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// factorGroup writes a group that has the same shape in every context,
+// replacing every field that differs between contexts with a variable.
+func (f *factorer) factorGroup(file string, groups map[string]rulefmt.RuleGroup) ([]byte, error) {
+	// Fields that differ are replaced by placeholders, which are
+	// swapped for template actions once the group is marshalled.
+	var placeholders []string
+	var actions []string
+	field := func(name string, get func(g rulefmt.RuleGroup) string) string {
+		values := make(map[string]string)
+		for _, context := range f.contexts {
+			values[context] = get(groups[context])
+		}
+		action, same := f.variable(name, values)
+		if same {
+			return values[f.contexts[0]]
+		}
+		placeholder := fmt.Sprintf("__IMPORT_PLACEHOLDER_%d__", len(placeholders))
+		placeholders = append(placeholders, placeholder)
+		actions = append(actions, action)
+		return placeholder
+	}
+
+	first := groups[f.contexts[0]]
+	prefix := file + "_" + first.Name
+	rv := rulefmt.RuleGroup{Name: first.Name}
+	rv.Interval = field(prefix+"_interval", func(g rulefmt.RuleGroup) string { return g.Interval })
+
+	for ix, r := range first.Rules {
+		ix := ix
+		rule := func(g rulefmt.RuleGroup) rulefmt.Rule { return g.Rules[ix] }
+		rulePrefix := fmt.Sprintf("%s_%s", prefix, r.Record+r.Alert)
+		out := rulefmt.Rule{}
+		if r.Record != "" {
+			out.Record = field(rulePrefix+"_record", func(g rulefmt.RuleGroup) string { return rule(g).Record })
+		} else {
+			out.Alert = field(rulePrefix+"_alert", func(g rulefmt.RuleGroup) string { return rule(g).Alert })
+		}
+		out.Expr = field(rulePrefix+"_expr", func(g rulefmt.RuleGroup) string { return rule(g).Expr })
+		out.For = field(rulePrefix+"_for", func(g rulefmt.RuleGroup) string { return rule(g).For })
+		for _, key := range sortedKeys(r.Labels) {
+			key := key
+			if out.Labels == nil {
+				out.Labels = make(map[string]string)
+			}
+			out.Labels[key] = field(rulePrefix+"_label_"+key, func(g rulefmt.RuleGroup) string { return rule(g).Labels[key] })
+		}
+		for _, key := range sortedKeys(r.Annotations) {
+			key := key
+			if out.Annotations == nil {
+				out.Annotations = make(map[string]string)
+			}
+			out.Annotations[key] = field(rulePrefix+"_annotation_"+key, func(g rulefmt.RuleGroup) string { return rule(g).Annotations[key] })
+		}
+		rv.Rules = append(rv.Rules, out)
+	}
+
+	data, err := yaml.Marshal([]rulefmt.RuleGroup{rv})
+	if err != nil {
+		return nil, err
+	}
+	text := string(data)
+	for ix, placeholder := range placeholders {
+		text = strings.Replace(text, placeholder, actions[ix], -1)
+	}
+	return []byte(text), nil
+}
+
+// variable looks at the value of a field in every context. If they are
+// all the same, same is true. Otherwise, a variable is created for the
+// field, and the template action expanding it is returned.
+func (f *factorer) variable(name string, values map[string]string) (action string, same bool) {
+	allSame, allContext := true, true
+	counts := make(map[string]int)
+	for _, context := range f.contexts {
+		counts[values[context]]++
+		allSame = allSame && values[context] == values[f.contexts[0]]
+		allContext = allContext && values[context] == context
+	}
+	if allSame {
+		return "", true
+	}
+	if allContext {
+		return "<{[ .Values.context | quote ]}>", false
+	}
+
+	name = f.uniqueName(name)
+	def := values[f.contexts[0]]
+	for _, context := range f.contexts {
+		if counts[values[context]] > counts[def] {
+			def = values[context]
+		}
+	}
+	f.set("default", name, def)
+	for _, context := range f.contexts {
+		if values[context] != def {
+			f.set(context, name, values[context])
+		}
+	}
+	return fmt.Sprintf("<{[ .Values.%s | quote ]}>", name), false
+}
+
+// uniqueName turns a description of a field into a variable name that
+// has not been used yet, and is usable as .Values.<name>.
+func (f *factorer) uniqueName(name string) string {
+	base := strings.Trim(nonIdentifier.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if base == "" || (base[0] >= '0' && base[0] <= '9') {
+		base = "v_" + base
+	}
+	rv := base
+	for ix := 2; f.names[rv]; ix++ {
+		rv = fmt.Sprintf("%s_%d", base, ix)
+	}
+	f.names[rv] = true
+	return rv
+}
+
+// set sets a variable for a context.
+func (f *factorer) set(context, name string, value interface{}) {
+	if f.values[context] == nil {
+		f.values[context] = make(map[string]interface{})
+	}
+	f.values[context][name] = value
+}
+
+// sortedKeys returns the keys of a map in sorted order.
+func sortedKeys(m map[string]string) []string {
+	var rv []string
+	for key := range m {
+		rv = append(rv, key)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Write writes the rule files and variables files to a directory,
+// which is created if needed. Existing files are never overwritten.
+func (r Result) Write(dir string) ([]string, error) {
+	contents := make(map[string][]byte)
+	for name, data := range r.Files {
+		contents[name] = data
+	}
+	for context, values := range r.Values {
+		data, err := yaml.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		contents[context+".vars"] = data
+	}
+
+	var names []string
+	for name := range contents {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return nil, fmt.Errorf("%s already exists", filepath.Join(dir, name))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents[name], 0644); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,107 @@
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+	"github.com/G-Research/prometheus-config-loader/templates"
+)
+
+func cpuRules(cluster, threshold, severity string) rulefmt.RuleGroups {
+	return rulefmt.RuleGroups{Groups: []rulefmt.RuleGroup{{
+		Name: "cpu",
+		Rules: []rulefmt.Rule{{
+			Alert:       "HighCPU",
+			Expr:        "cpu_usage > " + threshold,
+			For:         "5m",
+			Labels:      map[string]string{"cluster": cluster, "severity": severity},
+			Annotations: map[string]string{"summary": "CPU usage is {{ $value }}: high"},
+		}},
+	}}}
+}
+
+func TestFactorRoundTrip(t *testing.T) {
+	contexts := []string{"cluster-a", "cluster-b", "cluster-c"}
+	extra := rulefmt.RuleGroup{Name: "gpu", Rules: []rulefmt.Rule{{Record: "job:gpu:sum", Expr: "sum(gpu)"}}}
+	withGPU := cpuRules("cluster-c", "95", "warning")
+	withGPU.Groups = append(withGPU.Groups, extra)
+
+	sources := map[string]Source{
+		"cluster-a": {"node": cpuRules("cluster-a", "80", "warning"), "only-a": cpuRules("cluster-a", "1", "info")},
+		"cluster-b": {"node": cpuRules("cluster-b", "80", "critical")},
+		"cluster-c": {"node": withGPU},
+	}
+
+	result, err := Factor(contexts, sources)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "only-a.yaml") {
+		t.Errorf("Expected a warning about only-a.yaml, saw %v", result.Warnings)
+	}
+	expectedDefaults := map[string]interface{}{
+		"node_cpu_highcpu_expr":           "cpu_usage > 80",
+		"node_cpu_highcpu_label_severity": "warning",
+	}
+	if !reflect.DeepEqual(result.Values["default"], expectedDefaults) {
+		t.Errorf("Saw defaults %v, expected %v", result.Values["default"], expectedDefaults)
+	}
+	if _, ok := result.Values["cluster-a"]; ok {
+		t.Errorf("cluster-a only uses default values, but has %v", result.Values["cluster-a"])
+	}
+
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory, %s", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if _, err := result.Write(src); err != nil {
+		t.Fatalf("Unexpected error writing, %s", err)
+	}
+	if _, err := result.Write(src); err == nil {
+		t.Errorf("Expected an error overwriting existing files")
+	}
+
+	templates.DefaultTempDirectory = filepath.Join(dir, "out")
+	data, err := templates.ExpandDirectory(contexts, src, templates.Options{Strict: true})
+	if err != nil {
+		t.Fatalf("Unexpected error expanding, %s", err)
+	}
+	for _, context := range contexts {
+		buf, err := ioutil.ReadFile(filepath.Join(data[context].Directory, "node.yaml"))
+		if err != nil {
+			t.Errorf("Context %s, failed to read expanded rules, %s", context, err)
+			continue
+		}
+		var seen rulefmt.RuleGroups
+		if err := yaml.Unmarshal(buf, &seen); err != nil {
+			t.Errorf("Context %s, failed to parse expanded rules, %s\n%s", context, err, buf)
+			continue
+		}
+		if !reflect.DeepEqual(seen, sources[context]["node"]) {
+			t.Errorf("Context %s, saw %+v, expected %+v", context, seen, sources[context]["node"])
+		}
+	}
+}
+
+func TestFactorSingleContext(t *testing.T) {
+	sources := map[string]Source{"only": {"node": cpuRules("only", "80", "warning")}}
+	result, err := Factor([]string{"only"}, sources)
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+	if len(result.Values) != 0 {
+		t.Errorf("Expected no variables, saw %v", result.Values)
+	}
+	if strings.Contains(string(result.Files["node.yaml"]), "<{[") {
+		t.Errorf("Expected a plain rule file, saw:\n%s", result.Files["node.yaml"])
+	}
+}
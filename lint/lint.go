@@ -0,0 +1,254 @@
+// Package lint checks prometheus rule files against organisational
+// policies, such as naming conventions and required labels, that go
+// beyond what promtool checks.
+package lint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+)
+
+// SuppressAnnotation is the annotation listing the checks that should
+// not be run for a rule, as a comma-separated list. The same list can
+// be given in a comment on the rule, following suppressComment.
+const SuppressAnnotation = "lint_ignore"
+
+const suppressComment = "lint:ignore"
+
+var (
+	camelCase  = regexp.MustCompile(`^[A-Z][a-zA-Z0-9]*$`)
+	recordName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*:[a-zA-Z_][a-zA-Z0-9_]*:[a-zA-Z0-9_]+$`)
+)
+
+// Problem is a single policy violation in a rule file.
+type Problem struct {
+	FileName string
+	Group    string
+	// Index of the rule within its group, starting at 0
+	Index int
+	// Name of the alert or recording rule
+	Name  string
+	Check string
+	Level Level
+	Msg   string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: group %q, rule %d (%s): %s: %s", p.FileName, p.Group, p.Index, p.Name, p.Check, p.Msg)
+}
+
+// Problems is a list of policy violations.
+type Problems []Problem
+
+// Errors returns the number of problems at the error level.
+func (p Problems) Errors() int {
+	rv := 0
+	for _, problem := range p {
+		if problem.Level == Error {
+			rv++
+		}
+	}
+	return rv
+}
+
+// LintFile checks a rule file against the policy.
+func LintFile(policy *Policy, file string) (Problems, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Lint(policy, file, data)
+}
+
+// Lint checks the contents of a rule file against the policy. The file
+// name is only used to describe problems.
+func Lint(policy *Policy, file string, data []byte) (Problems, error) {
+	var groups rulefmt.RuleGroups
+	if err := yaml.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	suppressed, err := commentSuppressions(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	var rv Problems
+	for gx, g := range groups.Groups {
+		for ix, r := range g.Rules {
+			skip := parseSuppressions(r.Annotations[SuppressAnnotation])
+			for check := range suppressed[[2]int{gx, ix}] {
+				skip[check] = true
+			}
+			for _, p := range policy.checkRule(r) {
+				if skip[p.Check] {
+					continue
+				}
+				p.FileName = file
+				p.Group = g.Name
+				p.Index = ix
+				p.Name = r.Record + r.Alert
+				rv = append(rv, p)
+			}
+		}
+	}
+	return rv, nil
+}
+
+// checkRule runs all checks in the policy against a single rule,
+// returning the problems found, with only Check, Level and Msg set.
+func (p *Policy) checkRule(r rulefmt.Rule) Problems {
+	var rv Problems
+	fail := func(check string, level Level, format string, args ...interface{}) {
+		rv = append(rv, Problem{Check: check, Level: level, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if r.Record != "" {
+		if c := p.RecordName; c != nil && !recordName.MatchString(r.Record) {
+			fail(RecordNameCheck, c.Level, "recording rule name %s does not match level:metric:operations", r.Record)
+		}
+		return rv
+	}
+
+	if c := p.AlertName; c != nil && !camelCase.MatchString(r.Alert) {
+		fail(AlertNameCheck, c.Level, "alert name %s is not CamelCase", r.Alert)
+	}
+	severity, hasSeverity := r.Labels["severity"]
+	if c := p.SeverityLabel; c != nil {
+		switch {
+		case !hasSeverity:
+			fail(SeverityLabelCheck, c.Level, "no severity label")
+		case len(c.Allowed) > 0 && !contains(c.Allowed, severity):
+			fail(SeverityLabelCheck, c.Level, "severity %q is not one of %s", severity, strings.Join(c.Allowed, ", "))
+		}
+	}
+	if c := p.RequiredAnnotations; c != nil {
+		for _, name := range c.Annotations {
+			if r.Annotations[name] == "" {
+				fail(RequiredAnnotationsCheck, c.Level, "no %s annotation", name)
+			}
+		}
+	}
+	if c := p.PagingFor; c != nil && contains(c.Severities, severity) {
+		var d model.Duration
+		var err error
+		if r.For != "" {
+			d, err = model.ParseDuration(r.For)
+		}
+		if err == nil && time.Duration(d) < time.Duration(c.min) {
+			fail(PagingForCheck, c.Level, "alerts with severity %s need a for of at least %s", severity, c.Min)
+		}
+	}
+
+	return rv
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSuppressions parses a comma-separated list of check names into
+// a set.
+func parseSuppressions(list string) map[string]bool {
+	rv := make(map[string]bool)
+	for _, check := range strings.Split(list, ",") {
+		if check = strings.TrimSpace(check); check != "" {
+			rv[check] = true
+		}
+	}
+	return rv
+}
+
+// commentSuppressions finds the "lint:ignore" comments on every rule,
+// returning the suppressed checks keyed by group and rule index.
+// Comments on the line before a rule, or on any of its lines, apply to
+// the rule.
+func commentSuppressions(data []byte) (map[[2]int]map[string]bool, error) {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	rv := make(map[[2]int]map[string]bool)
+	for gx, group := range sequence(mappingValue(document(&root), "groups")) {
+		rules := mappingValue(group, "rules")
+		for ix, rule := range sequence(rules) {
+			checks := make(map[string]bool)
+			comments := ruleComments(rule)
+			if ix == 0 {
+				// A comment before the first rule may belong to
+				// the list of rules, rather than the rule.
+				comments = append(comments, rules.HeadComment)
+			}
+			for _, comment := range comments {
+				for _, line := range strings.Split(comment, "\n") {
+					line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "#"))
+					if strings.HasPrefix(line, suppressComment) {
+						for check := range parseSuppressions(strings.TrimPrefix(line, suppressComment)) {
+							checks[check] = true
+						}
+					}
+				}
+			}
+			if len(checks) > 0 {
+				rv[[2]int{gx, ix}] = checks
+			}
+		}
+	}
+	return rv, nil
+}
+
+// ruleComments returns the comments attached to a rule mapping and to
+// its keys and values.
+func ruleComments(rule *yamlv3.Node) []string {
+	rv := []string{rule.HeadComment, rule.LineComment}
+	if rule.Kind == yamlv3.MappingNode {
+		for _, n := range rule.Content {
+			rv = append(rv, n.HeadComment, n.LineComment)
+		}
+	}
+	return rv
+}
+
+// document returns the top-level node of a parsed document.
+func document(n *yamlv3.Node) *yamlv3.Node {
+	if n.Kind == yamlv3.DocumentNode && len(n.Content) > 0 {
+		return n.Content[0]
+	}
+	return n
+}
+
+// mappingValue returns the value for key in a mapping node, or nil.
+func mappingValue(n *yamlv3.Node, key string) *yamlv3.Node {
+	if n == nil || n.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	for ix := 0; ix+1 < len(n.Content); ix += 2 {
+		if n.Content[ix].Value == key {
+			return n.Content[ix+1]
+		}
+	}
+	return nil
+}
+
+// sequence returns the items of a sequence node, or nil.
+func sequence(n *yamlv3.Node) []*yamlv3.Node {
+	if n == nil || n.Kind != yamlv3.SequenceNode {
+		return nil
+	}
+	return n.Content
+}
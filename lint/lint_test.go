@@ -0,0 +1,93 @@
+package lint
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLintFile(t *testing.T) {
+	policy, err := LoadPolicy("testdata/policy.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error loading policy, %s", err)
+	}
+
+	problems, err := LintFile(policy, "testdata/rules.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	var seen []string
+	for _, p := range problems {
+		seen = append(seen, fmt.Sprintf("%s/%d %s %s", p.Group, p.Index, p.Check, p.Level))
+	}
+	expected := []string{
+		"bad/0 record_name warning",
+		"bad/1 alert_name error",
+		"bad/1 severity_label error",
+		"bad/1 required_annotations warning",
+		"bad/1 required_annotations warning",
+		"bad/2 paging_for error",
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Saw problems %v, expected %v", seen, expected)
+	}
+	if problems.Errors() != 3 {
+		t.Errorf("Saw %d errors, expected 3", problems.Errors())
+	}
+}
+
+func TestCheckRule(t *testing.T) {
+	policy, err := ParsePolicy("policy.yaml", []byte("paging_for:\n  min: 5m\nrecord_name: {}\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error loading policy, %s", err)
+	}
+
+	cases := []struct {
+		yaml     string
+		expected int
+	}{
+		{"groups:\n- name: a\n  rules:\n  - alert: A\n    expr: up == 0\n    for: 10m\n    labels:\n      severity: critical\n", 0},
+		{"groups:\n- name: a\n  rules:\n  - alert: A\n    expr: up == 0\n    for: 1m\n    labels:\n      severity: critical\n", 1},
+		{"groups:\n- name: a\n  rules:\n  - alert: A\n    expr: up == 0\n    labels:\n      severity: warning\n", 0},
+		{"groups:\n- name: a\n  rules:\n  - record: instance:up:sum\n    expr: sum(up)\n", 0},
+		{"groups:\n- name: a\n  rules:\n  - record: instance:up\n    expr: sum(up)\n", 1},
+		{"groups:\n- name: a\n  rules:\n  - record: instance_up\n    expr: sum(up)\n    annotations:\n      lint_ignore: record_name\n", 0},
+	}
+
+	for ix, td := range cases {
+		problems, err := Lint(policy, "rules.yaml", []byte(td.yaml))
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error, %s", ix, err)
+			continue
+		}
+		if len(problems) != td.expected {
+			t.Errorf("Case #%d, saw %d problems, expected %d: %v", ix, len(problems), td.expected, problems)
+		}
+		for _, p := range problems {
+			if p.Level != Error {
+				t.Errorf("Case #%d, saw level %s, expected the default of %s", ix, p.Level, Error)
+			}
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	cases := []struct {
+		yaml string
+		fail bool
+	}{
+		{"alert_name:\n  level: warning\n", false},
+		{"alert_name:\n  level: fatal\n", true},
+		{"alert_nmae:\n  level: error\n", true},
+		{"paging_for:\n  min: soon\n", true},
+		{"severity_label:\n  allowed: [critical]\n  level: error\n", false},
+	}
+
+	for ix, td := range cases {
+		_, err := ParsePolicy("policy.yaml", []byte(td.yaml))
+		if (err != nil) != td.fail {
+			t.Errorf("Case #%d, unexpected error status, %v", ix, err)
+		}
+	}
+}
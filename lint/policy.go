@@ -0,0 +1,131 @@
+package lint
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/G-Research/prometheus-config-loader/strictyaml"
+)
+
+// Level is how serious a problem found by a check is. Errors stop the
+// rules from being uploaded, warnings are only reported.
+type Level string
+
+// Valid levels. A check in the policy with no level is at the Error
+// level, checks not in the policy are not run.
+const (
+	Error   Level = "error"
+	Warning Level = "warning"
+)
+
+// Names of the built-in checks, as used in policy files and to
+// suppress problems.
+const (
+	SeverityLabelCheck       = "severity_label"
+	RequiredAnnotationsCheck = "required_annotations"
+	AlertNameCheck           = "alert_name"
+	RecordNameCheck          = "record_name"
+	PagingForCheck           = "paging_for"
+)
+
+// CheckPolicy holds the settings common to all checks.
+type CheckPolicy struct {
+	Level Level `yaml:"level"`
+}
+
+// SeverityLabelPolicy configures the check that every alert has a
+// severity label, with one of the allowed values. If Allowed is empty,
+// any value is accepted.
+type SeverityLabelPolicy struct {
+	CheckPolicy `yaml:",inline"`
+	Allowed     []string `yaml:"allowed"`
+}
+
+// RequiredAnnotationsPolicy configures the check that every alert has
+// all of the listed annotations.
+type RequiredAnnotationsPolicy struct {
+	CheckPolicy `yaml:",inline"`
+	Annotations []string `yaml:"annotations"`
+}
+
+// PagingForPolicy configures the check that alerts with one of the
+// listed severities only fire after at least Min.
+type PagingForPolicy struct {
+	CheckPolicy `yaml:",inline"`
+	Severities  []string `yaml:"severities"`
+	Min         string   `yaml:"min"`
+
+	min model.Duration
+}
+
+// Policy selects which checks are run, and how. Checks that are not
+// set are not run.
+type Policy struct {
+	SeverityLabel       *SeverityLabelPolicy       `yaml:"severity_label"`
+	RequiredAnnotations *RequiredAnnotationsPolicy `yaml:"required_annotations"`
+	AlertName           *CheckPolicy               `yaml:"alert_name"`
+	RecordName          *CheckPolicy               `yaml:"record_name"`
+	PagingFor           *PagingForPolicy           `yaml:"paging_for"`
+}
+
+// LoadPolicy reads and validates a policy file.
+func LoadPolicy(name string) (*Policy, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(name, data)
+}
+
+// ParsePolicy parses and validates the contents of a policy file. The
+// file name is only used in error messages.
+func ParsePolicy(name string, data []byte) (*Policy, error) {
+	var rv Policy
+	if err := strictyaml.Unmarshal(name, data, &rv, true); err != nil {
+		return nil, err
+	}
+
+	levels := map[string]*CheckPolicy{}
+	if rv.SeverityLabel != nil {
+		levels[SeverityLabelCheck] = &rv.SeverityLabel.CheckPolicy
+	}
+	if rv.RequiredAnnotations != nil {
+		levels[RequiredAnnotationsCheck] = &rv.RequiredAnnotations.CheckPolicy
+	}
+	if rv.AlertName != nil {
+		levels[AlertNameCheck] = rv.AlertName
+	}
+	if rv.RecordName != nil {
+		levels[RecordNameCheck] = rv.RecordName
+	}
+	if rv.PagingFor != nil {
+		levels[PagingForCheck] = &rv.PagingFor.CheckPolicy
+	}
+	for check, policy := range levels {
+		switch policy.Level {
+		case Error, Warning:
+		case "":
+			policy.Level = Error
+		default:
+			return nil, fmt.Errorf("%s: %s: unknown level %q, expected error or warning", name, check, policy.Level)
+		}
+	}
+
+	if p := rv.PagingFor; p != nil {
+		if len(p.Severities) == 0 {
+			p.Severities = []string{"critical"}
+		}
+		if p.Min == "" {
+			p.Min = "1m"
+		}
+		min, err := model.ParseDuration(p.Min)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: invalid min: %s", name, PagingForCheck, err)
+		}
+		p.min = min
+	}
+
+	return &rv, nil
+}
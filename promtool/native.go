@@ -0,0 +1,243 @@
+package promtool
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/template"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+	"github.com/G-Research/prometheus-config-loader/strictyaml"
+)
+
+// Checker is anything that can syntax-check a prometheus rule file,
+// returning a human-readable report and an error if the file is not
+// valid.
+type Checker interface {
+	Check(file string) (string, error)
+}
+
+// RuleError describes a problem with a single rule in a rule file.
+type RuleError struct {
+	FileName string
+	Group    string
+	// Index of the rule within its group, starting at 0
+	Index int
+	// Name of the alert or recording rule, if it has one
+	Name string
+	Err  error
+}
+
+func (r RuleError) Error() string {
+	return fmt.Sprintf("%s: group %q, rule %d (%s): %s", r.FileName, r.Group, r.Index, r.Name, r.Err)
+}
+
+// CheckErrors collects all problems found in a single rule file.
+type CheckErrors []error
+
+func (c CheckErrors) Error() string {
+	var msgs []string
+	for _, err := range c {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Native is a Checker that validates rule files in-process, without
+// needing the promtool executable.
+//
+// Checking expressions and alert templates the way prometheus does
+// needs prometheus' own PromQL parser and template expander, so this
+// is the one package that depends on prometheus itself. Only those
+// packages of it are built, and the rest of the tree, cfgloader in
+// particular, sticks to its own copy of the rule file format.
+type Native struct{}
+
+// NewNative returns a Native checker.
+func NewNative() *Native {
+	return &Native{}
+}
+
+// Check parses a prometheus rule file and validates every rule in it,
+// mirroring what "promtool check rules" does. Like promtool, it
+// rejects unknown fields and duplicate keys.
+func (n *Native) Check(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	var groups rulefmt.RuleGroups
+	if err := strictyaml.Unmarshal(file, data, &groups, true); err != nil {
+		return "", err
+	}
+
+	errs, count := checkRuleGroups(file, groups)
+	if len(errs) > 0 {
+		return "", errs
+	}
+
+	return fmt.Sprintf("Checking %s\n  SUCCESS: %d rules found\n", file, count), nil
+}
+
+// checkRuleGroups validates all groups in a rule file, returning any
+// problems found and the number of rules seen.
+func checkRuleGroups(file string, groups rulefmt.RuleGroups) (CheckErrors, int) {
+	var errs CheckErrors
+	count := 0
+
+	if len(groups.Groups) == 0 {
+		errs = append(errs, fmt.Errorf("%s: no groups found", file))
+	}
+
+	seen := make(map[string]bool)
+	for _, g := range groups.Groups {
+		if g.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: group name should not be empty", file))
+		}
+		if seen[g.Name] {
+			errs = append(errs, fmt.Errorf("%s: group %q is repeated in the same file", file, g.Name))
+		}
+		seen[g.Name] = true
+
+		if g.Interval != "" {
+			if _, err := model.ParseDuration(g.Interval); err != nil {
+				errs = append(errs, fmt.Errorf("%s: group %q, invalid interval: %s", file, g.Name, err))
+			}
+		}
+		if g.QueryOffset != "" {
+			if _, err := model.ParseDuration(g.QueryOffset); err != nil {
+				errs = append(errs, fmt.Errorf("%s: group %q, invalid query_offset: %s", file, g.Name, err))
+			}
+		}
+		if g.Limit < 0 {
+			errs = append(errs, fmt.Errorf("%s: group %q, limit must not be negative", file, g.Name))
+		}
+		switch strings.ToLower(g.PartialResponseStrategy) {
+		case "", "warn", "abort":
+		default:
+			errs = append(errs, fmt.Errorf("%s: group %q, partial_response_strategy must be warn or abort, not %q", file, g.Name, g.PartialResponseStrategy))
+		}
+		for _, name := range sortedKeys(g.Labels) {
+			if !model.LabelName(name).IsValid() {
+				errs = append(errs, fmt.Errorf("%s: group %q, invalid label name: %s", file, g.Name, name))
+			}
+		}
+
+		for ix, r := range g.Rules {
+			count++
+			for _, err := range checkRule(r) {
+				errs = append(errs, RuleError{
+					FileName: file,
+					Group:    g.Name,
+					Index:    ix,
+					Name:     r.Record + r.Alert,
+					Err:      err,
+				})
+			}
+		}
+	}
+
+	return errs, count
+}
+
+// checkRule validates a single rule, returning all problems found.
+func checkRule(r rulefmt.Rule) []error {
+	var errs []error
+
+	if r.Record != "" && r.Alert != "" {
+		errs = append(errs, fmt.Errorf("only one of 'record' and 'alert' must be set"))
+	}
+	if r.Record == "" && r.Alert == "" {
+		errs = append(errs, fmt.Errorf("one of 'record' or 'alert' must be set"))
+	}
+
+	if r.Expr == "" {
+		errs = append(errs, fmt.Errorf("field 'expr' must be set in rule"))
+	} else if _, err := promql.ParseExpr(r.Expr); err != nil {
+		errs = append(errs, fmt.Errorf("could not parse expression: %s", err))
+	}
+
+	if r.Record != "" {
+		if len(r.Annotations) > 0 {
+			errs = append(errs, fmt.Errorf("invalid field 'annotations' in recording rule"))
+		}
+		if r.For != "" {
+			errs = append(errs, fmt.Errorf("invalid field 'for' in recording rule"))
+		}
+		if r.KeepFiringFor != "" {
+			errs = append(errs, fmt.Errorf("invalid field 'keep_firing_for' in recording rule"))
+		}
+		if !model.IsValidMetricName(model.LabelValue(r.Record)) {
+			errs = append(errs, fmt.Errorf("invalid recording rule name: %s", r.Record))
+		}
+	}
+
+	if r.For != "" {
+		if _, err := model.ParseDuration(r.For); err != nil {
+			errs = append(errs, fmt.Errorf("invalid 'for' duration: %s", err))
+		}
+	}
+	if r.KeepFiringFor != "" {
+		if _, err := model.ParseDuration(r.KeepFiringFor); err != nil {
+			errs = append(errs, fmt.Errorf("invalid 'keep_firing_for' duration: %s", err))
+		}
+	}
+
+	for _, name := range sortedKeys(r.Labels) {
+		if !model.LabelName(name).IsValid() {
+			errs = append(errs, fmt.Errorf("invalid label name: %s", name))
+		}
+	}
+	for _, name := range sortedKeys(r.Annotations) {
+		if !model.LabelName(name).IsValid() {
+			errs = append(errs, fmt.Errorf("invalid annotation name: %s", name))
+		}
+	}
+
+	if r.Alert != "" {
+		errs = append(errs, checkTemplates(r)...)
+	}
+
+	return errs
+}
+
+// checkTemplates verifies that all label and annotation values of an
+// alerting rule are valid prometheus templates.
+func checkTemplates(r rulefmt.Rule) []error {
+	var errs []error
+
+	// Same preamble prometheus uses when expanding alert templates
+	defs := "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$value := .Value}}"
+	parse := func(kind, name, text string) {
+		tmpl := template.NewTemplateExpander(context.Background(), defs+text, "__alert_"+r.Alert, nil, model.Time(0), nil, nil)
+		if err := tmpl.ParseTest(); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q: %s", kind, name, err))
+		}
+	}
+
+	for _, name := range sortedKeys(r.Labels) {
+		parse("label", name, r.Labels[name])
+	}
+	for _, name := range sortedKeys(r.Annotations) {
+		parse("annotation", name, r.Annotations[name])
+	}
+
+	return errs
+}
+
+// sortedKeys returns the keys of a map in sorted order, so errors are
+// reported in a stable order.
+func sortedKeys(m map[string]string) []string {
+	var rv []string
+	for key := range m {
+		rv = append(rv, key)
+	}
+	sort.Strings(rv)
+	return rv
+}
@@ -0,0 +1,63 @@
+package promtool
+
+import (
+	"testing"
+)
+
+// Test the native checker against the same files promtool is tested with
+func TestNativeCheck(t *testing.T) {
+	n := NewNative()
+
+	tests := []struct {
+		Filename string
+		Valid    bool
+	}{
+		{Filename: "testdata/valid/valid1.yaml", Valid: true},
+		{Filename: "testdata/mixed/valid1.yaml", Valid: true},
+		{Filename: "testdata/invalid/invalid1.yaml", Valid: false},
+		{Filename: "testdata/invalid/notarule.yaml", Valid: false},
+		{Filename: "testdata/native/badfor.yaml", Valid: false},
+		{Filename: "testdata/native/badtemplate.yaml", Valid: false},
+		{Filename: "testdata/native/recordandalert.yaml", Valid: false},
+		{Filename: "testdata/native/badlabel.yaml", Valid: false},
+		{Filename: "testdata/native/unknownfield.yaml", Valid: false},
+		{Filename: "testdata/native/duplicatekey.yaml", Valid: false},
+		{Filename: "testdata/native/strategy.yaml", Valid: true},
+		{Filename: "testdata/native/badstrategy.yaml", Valid: false},
+		{Filename: "testdata/native/nonexistant.yaml", Valid: false},
+	}
+
+	for _, test := range tests {
+		stdout, err := n.Check(test.Filename)
+		if test.Valid {
+			if err != nil {
+				t.Errorf("%s should be valid, but the native checker failed:\n%s", test.Filename, err)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("%s should be invalid, but the native checker returned success:\n%s", test.Filename, stdout)
+			}
+		}
+	}
+}
+
+// Errors for individual rules should say where the rule is
+func TestNativeCheckLocation(t *testing.T) {
+	n := NewNative()
+
+	_, err := n.Check("testdata/invalid/invalid1.yaml")
+	errs, ok := err.(CheckErrors)
+	if !ok {
+		t.Fatalf("Expected CheckErrors, got %v", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Expected exactly one error, got %d: %s", len(errs), errs)
+	}
+	rerr, ok := errs[0].(RuleError)
+	if !ok {
+		t.Fatalf("Expected RuleError, got %v", errs[0])
+	}
+	if rerr.FileName != "testdata/invalid/invalid1.yaml" || rerr.Group != "valid-data-1" || rerr.Index != 0 || rerr.Name != "job:test_invalid:sum" {
+		t.Errorf("Unexpected error location, %#v", rerr)
+	}
+}
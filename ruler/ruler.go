@@ -0,0 +1,167 @@
+// Package ruler is a client for the rules API of Cortex and the rulers
+// that share it, such as Mimir and Loki. Rule groups are stored in
+// namespaces, each namespace being the equivalent of a rule file, and
+// every tenant has its own set of namespaces. The Thanos ruler has no
+// API for writing rules, it only reads rule files.
+package ruler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+)
+
+// rulesPath is the path of the rules API, relative to the base URL of
+// the ruler.
+const rulesPath = "/api/v1/rules"
+
+// tenantHeader is the header carrying the tenant ID.
+const tenantHeader = "X-Scope-OrgID"
+
+// Client talks to the rules API of a single ruler, as a single tenant.
+type Client struct {
+	// Base URL of the ruler, including any path prefix, e.g.
+	// https://mimir.example.com or https://loki.example.com/loki
+	URL string
+	// Tenant ID, not sent if empty
+	TenantID string
+	// Basic authentication, used if Username is not empty
+	Username string
+	Password string
+	// Bearer token authentication, used if not empty
+	BearerToken string
+	// HTTP client to use, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// Error is a response from the ruler that was not a success.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), strings.TrimSpace(e.Body))
+}
+
+// IsNotFound reports whether err is a not found response.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// List returns the rule groups in every namespace.
+func (c *Client) List() (map[string][]rulefmt.RuleGroup, error) {
+	rv := make(map[string][]rulefmt.RuleGroup)
+	data, err := c.do(http.MethodGet, rulesPath, nil)
+	if IsNotFound(err) {
+		// Cortex answers with a 404 when there are no rules
+		return rv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &rv); err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %s", err)
+	}
+	return rv, nil
+}
+
+// Get returns the rule groups in a namespace. A namespace that does
+// not exist has no groups.
+func (c *Client) Get(namespace string) ([]rulefmt.RuleGroup, error) {
+	data, err := c.do(http.MethodGet, namespacePath(namespace), nil)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rv map[string][]rulefmt.RuleGroup
+	if err := yaml.Unmarshal(data, &rv); err != nil {
+		return nil, fmt.Errorf("failed to parse rules in %s: %s", namespace, err)
+	}
+	return rv[namespace], nil
+}
+
+// SetGroup creates a rule group in a namespace, or replaces the group
+// of the same name.
+func (c *Client) SetGroup(namespace string, group rulefmt.RuleGroup) error {
+	data, err := yaml.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(http.MethodPost, namespacePath(namespace), data)
+	return err
+}
+
+// DeleteGroup deletes a rule group from a namespace.
+func (c *Client) DeleteGroup(namespace, group string) error {
+	_, err := c.do(http.MethodDelete, namespacePath(namespace)+"/"+url.PathEscape(group), nil)
+	return err
+}
+
+// DeleteNamespace deletes a namespace, with all its rule groups.
+func (c *Client) DeleteNamespace(namespace string) error {
+	_, err := c.do(http.MethodDelete, namespacePath(namespace), nil)
+	return err
+}
+
+// namespacePath returns the API path of a namespace.
+func namespacePath(namespace string) string {
+	return rulesPath + "/" + url.PathEscape(namespace)
+}
+
+// do sends a request to the ruler, returning the body of the response
+// if it was a success.
+func (c *Client) do(method, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	u := strings.TrimSuffix(c.URL, "/") + path
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+	if c.TenantID != "" {
+		req.Header.Set(tenantHeader, c.TenantID)
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &Error{Method: method, URL: u, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	return data, nil
+}
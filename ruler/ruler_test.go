@@ -0,0 +1,86 @@
+package ruler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+	"github.com/G-Research/prometheus-config-loader/ruler/rulertest"
+)
+
+func group(name, expr string) rulefmt.RuleGroup {
+	return rulefmt.RuleGroup{Name: name, Rules: []rulefmt.Rule{{Record: "job:up:sum", Expr: expr}}}
+}
+
+func TestClient(t *testing.T) {
+	server := rulertest.NewServer()
+	defer server.Close()
+	server.Tenant = "team-a"
+	server.Authorization = "Bearer secret"
+
+	c := &Client{URL: server.URL + "/", TenantID: "team-a", BearerToken: "secret"}
+
+	all, err := c.List()
+	if err != nil || len(all) != 0 {
+		t.Errorf("Expected no rules, saw %v, %v", all, err)
+	}
+	groups, err := c.Get("k8s-node-rules")
+	if err != nil || groups != nil {
+		t.Errorf("Expected no groups, saw %v, %v", groups, err)
+	}
+
+	for _, g := range []rulefmt.RuleGroup{group("a", "sum(up)"), group("b", "sum(up)"), group("a", "sum(up) by (job)")} {
+		if err := c.SetGroup("k8s-node-rules", g); err != nil {
+			t.Fatalf("Unexpected error setting group %s, %s", g.Name, err)
+		}
+	}
+	expected := []rulefmt.RuleGroup{group("a", "sum(up) by (job)"), group("b", "sum(up)")}
+	groups, err = c.Get("k8s-node-rules")
+	if err != nil || !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Saw groups %v, %v, expected %v", groups, err, expected)
+	}
+	all, err = c.List()
+	if err != nil || !reflect.DeepEqual(all, map[string][]rulefmt.RuleGroup{"k8s-node-rules": expected}) {
+		t.Errorf("Saw rules %v, %v", all, err)
+	}
+
+	if err := c.DeleteGroup("k8s-node-rules", "a"); err != nil {
+		t.Errorf("Unexpected error deleting group, %s", err)
+	}
+	if groups := server.Rules("team-a", "k8s-node-rules"); !reflect.DeepEqual(groups, expected[1:]) {
+		t.Errorf("Saw groups %v after deleting a", groups)
+	}
+	if err := c.DeleteNamespace("k8s-node-rules"); err != nil {
+		t.Errorf("Unexpected error deleting namespace, %s", err)
+	}
+	if err := c.DeleteNamespace("k8s-node-rules"); !IsNotFound(err) {
+		t.Errorf("Expected not found deleting the namespace again, saw %v", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	server := rulertest.NewServer()
+	defer server.Close()
+	server.Tenant = "team-a"
+
+	cases := []struct {
+		client Client
+		status int
+	}{
+		{Client{URL: server.URL, TenantID: "team-b"}, 401},
+		{Client{URL: server.URL + "/elsewhere", TenantID: "team-a"}, 404},
+	}
+
+	for ix, td := range cases {
+		err := td.client.SetGroup("ns", group("a", "sum(up)"))
+		e, ok := err.(*Error)
+		if !ok || e.StatusCode != td.status {
+			t.Errorf("Case #%d, expected status %d, saw %v", ix, td.status, err)
+		}
+	}
+
+	c := Client{URL: server.URL, TenantID: "team-a"}
+	if err := c.SetGroup("ns", rulefmt.RuleGroup{}); err == nil {
+		t.Errorf("Expected an error setting a group without a name")
+	}
+}
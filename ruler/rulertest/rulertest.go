@@ -0,0 +1,169 @@
+// Package rulertest provides an in-memory stand-in for the rules API of
+// a Prometheus-compatible ruler, for use in tests.
+package rulertest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+)
+
+// Server is a ruler holding its rules in memory, keyed by tenant, then
+// namespace.
+type Server struct {
+	*httptest.Server
+
+	lock  sync.Mutex
+	rules map[string]map[string][]rulefmt.RuleGroup
+	// Requests received, as "<method> <path>"
+	Requests []string
+	// If not empty, the tenant every request must be for
+	Tenant string
+	// If not empty, the Authorization header every request must have
+	Authorization string
+}
+
+// NewServer starts a ruler with no rules. Close it when done.
+func NewServer() *Server {
+	rv := &Server{rules: make(map[string]map[string][]rulefmt.RuleGroup)}
+	rv.Server = httptest.NewServer(http.HandlerFunc(rv.serve))
+	return rv
+}
+
+// Rules returns the rule groups in a namespace of a tenant.
+func (s *Server) Rules(tenant, namespace string) []rulefmt.RuleGroup {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rules[tenant][namespace]
+}
+
+// SetRules replaces the rule groups in a namespace of a tenant.
+func (s *Server) SetRules(tenant, namespace string, groups []rulefmt.RuleGroup) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rules[tenant] == nil {
+		s.rules[tenant] = make(map[string][]rulefmt.RuleGroup)
+	}
+	s.rules[tenant][namespace] = groups
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Requests = append(s.Requests, r.Method+" "+r.URL.EscapedPath())
+
+	tenant := r.Header.Get("X-Scope-OrgID")
+	if s.Tenant != "" && tenant != s.Tenant {
+		http.Error(w, "unknown tenant", http.StatusUnauthorized)
+		return
+	}
+	if s.Authorization != "" && r.Header.Get("Authorization") != s.Authorization {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, "/api/v1/rules") {
+		http.NotFound(w, r)
+		return
+	}
+	var parts []string
+	if rest := strings.Trim(strings.TrimPrefix(path, "/api/v1/rules"), "/"); rest != "" {
+		for _, part := range strings.Split(rest, "/") {
+			part, err := url.PathUnescape(part)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			parts = append(parts, part)
+		}
+	}
+	namespaces := s.rules[tenant]
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 0:
+		if len(namespaces) == 0 {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+			return
+		}
+		writeYAML(w, namespaces)
+	case r.Method == http.MethodGet && len(parts) == 1:
+		groups, ok := namespaces[parts[0]]
+		if !ok {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+			return
+		}
+		writeYAML(w, map[string][]rulefmt.RuleGroup{parts[0]: groups})
+	case r.Method == http.MethodPost && len(parts) == 1:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var group rulefmt.RuleGroup
+		if err := yaml.UnmarshalStrict(data, &group); err != nil || group.Name == "" {
+			http.Error(w, "invalid rule group", http.StatusBadRequest)
+			return
+		}
+		if s.rules[tenant] == nil {
+			s.rules[tenant] = make(map[string][]rulefmt.RuleGroup)
+		}
+		groups := s.rules[tenant][parts[0]]
+		replaced := false
+		for ix, g := range groups {
+			if g.Name == group.Name {
+				groups[ix] = group
+				replaced = true
+			}
+		}
+		if !replaced {
+			groups = append(groups, group)
+		}
+		s.rules[tenant][parts[0]] = groups
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodDelete && len(parts) == 1:
+		if _, ok := namespaces[parts[0]]; !ok {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+			return
+		}
+		delete(namespaces, parts[0])
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodDelete && len(parts) == 2:
+		var kept []rulefmt.RuleGroup
+		for _, g := range namespaces[parts[0]] {
+			if g.Name != parts[1] {
+				kept = append(kept, g)
+			}
+		}
+		if len(kept) == len(namespaces[parts[0]]) {
+			http.Error(w, "no rule group found", http.StatusNotFound)
+			return
+		}
+		if len(kept) == 0 {
+			delete(namespaces, parts[0])
+		} else {
+			namespaces[parts[0]] = kept
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeYAML writes a value as a YAML response.
+func writeYAML(w http.ResponseWriter, v interface{}) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
@@ -0,0 +1,189 @@
+// Package strictyaml decodes YAML the same way gopkg.in/yaml.v2 does,
+// but can first reject unknown fields and duplicate keys, reporting
+// the line and column of each offending key.
+package strictyaml
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Error describes a single problem with a key in a YAML document.
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// Errors is a list of all problems found in a YAML document.
+type Errors []Error
+
+func (e Errors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// Unmarshal decodes data into out. If strict is set, data is first
+// checked for keys that do not correspond to any field in out and
+// for keys that occur more than once in the same mapping. The file
+// name is only used in error messages.
+func Unmarshal(file string, data []byte, out interface{}, strict bool) error {
+	if strict {
+		if err := Check(file, data, out); err != nil {
+			return err
+		}
+	}
+	return yaml.Unmarshal(data, out)
+}
+
+// Check verifies that data only has keys corresponding to fields in
+// out (which is not modified), and that no mapping has duplicate keys.
+func Check(file string, data []byte, out interface{}) error {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		if file == "" {
+			return err
+		}
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	c := checker{file: file}
+	c.walk(&root, reflect.TypeOf(out))
+	if len(c.errs) > 0 {
+		return c.errs
+	}
+	return nil
+}
+
+// checker collects errors while walking a YAML node tree.
+type checker struct {
+	file string
+	errs Errors
+}
+
+func (c *checker) fail(n *yamlv3.Node, format string, args ...interface{}) {
+	c.errs = append(c.errs, Error{File: c.file, Line: n.Line, Column: n.Column, Msg: fmt.Sprintf(format, args...)})
+}
+
+// walk checks node n against the type t it would be decoded into. A
+// nil t means anything goes, but duplicate keys are still reported.
+func (c *checker) walk(n *yamlv3.Node, t reflect.Type) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != nil && (t.Kind() == reflect.Interface || reflect.PtrTo(t).Implements(unmarshalerType)) {
+		t = nil
+	}
+
+	switch n.Kind {
+	case yamlv3.DocumentNode:
+		for _, child := range n.Content {
+			c.walk(child, t)
+		}
+	case yamlv3.SequenceNode:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for _, child := range n.Content {
+			c.walk(child, elem)
+		}
+	case yamlv3.MappingNode:
+		c.walkMapping(n, t)
+	}
+}
+
+// walkMapping checks all keys of a mapping node, then the values.
+func (c *checker) walkMapping(n *yamlv3.Node, t reflect.Type) {
+	var fields map[string]reflect.Type
+	var elem reflect.Type
+	if t != nil {
+		switch t.Kind() {
+		case reflect.Struct:
+			fields = structFields(t)
+		case reflect.Map:
+			elem = t.Elem()
+		}
+	}
+
+	seen := make(map[string]*yamlv3.Node)
+	for ix := 0; ix+1 < len(n.Content); ix += 2 {
+		key, value := n.Content[ix], n.Content[ix+1]
+		if key.Kind != yamlv3.ScalarNode || key.Value == "<<" {
+			c.walk(value, nil)
+			continue
+		}
+
+		if first, ok := seen[key.Value]; ok {
+			c.fail(key, "key %q already set at line %d, column %d", key.Value, first.Line, first.Column)
+		} else {
+			seen[key.Value] = key
+		}
+
+		if fields == nil {
+			c.walk(value, elem)
+			continue
+		}
+		ft, ok := fields[key.Value]
+		if !ok {
+			c.fail(key, "field %q not found in %s", key.Value, t)
+			continue
+		}
+		c.walk(value, ft)
+	}
+}
+
+// structFields returns the YAML keys of a struct type, mapped to the
+// types of the corresponding fields, following the yaml.v2 tag rules.
+func structFields(t reflect.Type) map[string]reflect.Type {
+	rv := make(map[string]reflect.Type)
+	for ix := 0; ix < t.NumField(); ix++ {
+		f := t.Field(ix)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "" && !strings.Contains(string(f.Tag), ":") {
+			tag = string(f.Tag)
+		}
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		inline := false
+		for _, flag := range parts[1:] {
+			if flag == "inline" {
+				inline = true
+			}
+		}
+		if inline && f.Type.Kind() == reflect.Struct {
+			for key, ft := range structFields(f.Type) {
+				rv[key] = ft
+			}
+			continue
+		}
+		name := parts[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		rv[name] = f.Type
+	}
+	return rv
+}
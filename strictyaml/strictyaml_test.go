@@ -0,0 +1,95 @@
+package strictyaml
+
+import (
+	"testing"
+)
+
+type inner struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type embedded struct {
+	Extra string `yaml:"extra"`
+}
+
+type outer struct {
+	Items    []inner `yaml:"items"`
+	Plain    string
+	Anything interface{} `yaml:"anything"`
+	embedded `yaml:",inline"`
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		yaml     string
+		expected []Error
+	}{
+		{"", nil},
+		{"items:\n  - name: a\n    labels:\n      x: y\nplain: p\nextra: e\n", nil},
+		{"anything:\n  whatever: [1, 2]\n  goes: here\n", nil},
+		{
+			"items:\n  - name: a\n    lables:\n      x: y\n",
+			[]Error{{Line: 3, Column: 5, Msg: `field "lables" not found in strictyaml.inner`}},
+		},
+		{
+			"items:\n  - name: a\n    name: b\n",
+			[]Error{{Line: 3, Column: 5, Msg: `key "name" already set at line 2, column 5`}},
+		},
+		{
+			"items:\n  - name: a\n    labels:\n      x: y\n      x: z\n",
+			[]Error{{Line: 5, Column: 7, Msg: `key "x" already set at line 4, column 7`}},
+		},
+		{
+			"anything:\n  a: 1\n  a: 2\nbogus: 3\n",
+			[]Error{
+				{Line: 3, Column: 3, Msg: `key "a" already set at line 2, column 3`},
+				{Line: 4, Column: 1, Msg: `field "bogus" not found in strictyaml.outer`},
+			},
+		},
+	}
+
+	for ix, td := range cases {
+		err := Check("", []byte(td.yaml), &outer{})
+		if td.expected == nil {
+			if err != nil {
+				t.Errorf("Case #%d, unexpected error %s", ix, err)
+			}
+			continue
+		}
+		errs, ok := err.(Errors)
+		if !ok {
+			t.Errorf("Case #%d, expected Errors, saw %v", ix, err)
+			continue
+		}
+		if len(errs) != len(td.expected) {
+			t.Errorf("Case #%d, saw %d errors, expected %d (%s)", ix, len(errs), len(td.expected), errs)
+			continue
+		}
+		for jx := range errs {
+			if errs[jx] != td.expected[jx] {
+				t.Errorf("Case #%d, error %d, saw %#v, expected %#v", ix, jx, errs[jx], td.expected[jx])
+			}
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	data := []byte("items:\n  - name: a\n    nmae: b\n")
+
+	var seen outer
+	if err := Unmarshal("test.yaml", data, &seen, false); err != nil {
+		t.Errorf("Unexpected error in non-strict mode, %s", err)
+	}
+	if len(seen.Items) != 1 || seen.Items[0].Name != "a" {
+		t.Errorf("Unexpected result, %#v", seen)
+	}
+
+	err := Unmarshal("test.yaml", data, &outer{}, true)
+	if err == nil {
+		t.Fatalf("Expected an error in strict mode")
+	}
+	if err.Error() != `test.yaml:3:5: field "nmae" not found in strictyaml.inner` {
+		t.Errorf("Unexpected error message, %s", err)
+	}
+}
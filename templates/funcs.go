@@ -0,0 +1,336 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// funcMap returns the functions available in rule templates, in
+// addition to the text/template builtins. See the README for a
+// description of each.
+func funcMap() template.FuncMap {
+	return template.FuncMap{
+		// Strings
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(from, to, s string) string { return strings.Replace(s, from, to, -1) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       join,
+		"quote":      func(val interface{}) string { return strconv.Quote(fmt.Sprint(val)) },
+		"squote":     func(val interface{}) string { return "'" + fmt.Sprint(val) + "'" },
+
+		// PromQL regular expressions
+		"regexQuote":       regexQuote,
+		"regexAlternation": regexAlternation,
+
+		// Defaults
+		"default":    defaultValue,
+		"required":   required,
+		optionalFunc: optional,
+
+		// Arithmetic
+		"add":   func(a, b interface{}) (interface{}, error) { return arithmetic("add", a, b) },
+		"sub":   func(a, b interface{}) (interface{}, error) { return arithmetic("sub", a, b) },
+		"mul":   func(a, b interface{}) (interface{}, error) { return arithmetic("mul", a, b) },
+		"div":   func(a, b interface{}) (interface{}, error) { return arithmetic("div", a, b) },
+		"mod":   func(a, b interface{}) (interface{}, error) { return arithmetic("mod", a, b) },
+		"max":   func(a interface{}, rest ...interface{}) (interface{}, error) { return extreme("max", a, rest) },
+		"min":   func(a interface{}, rest ...interface{}) (interface{}, error) { return extreme("min", a, rest) },
+		"int":   toInt,
+		"float": toFloat,
+
+		// Durations
+		"durationSeconds": durationSeconds,
+		"formatDuration":  formatDuration,
+
+		// Lists and dictionaries
+		"list":   func(items ...interface{}) []interface{} { return items },
+		"dict":   dict,
+		"keys":   keys,
+		"hasKey": func(m map[string]interface{}, key string) bool { _, ok := m[key]; return ok },
+		"has":    has,
+		"concat": concat,
+
+		// Formatting
+		"toYaml":  toYaml,
+		"indent":  indent,
+		"nindent": func(n int, s string) string { return "\n" + indent(n, s) },
+	}
+}
+
+// toList converts any slice or array to a []interface{}.
+func toList(val interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, got %T", val)
+	}
+	rv := make([]interface{}, v.Len())
+	for ix := range rv {
+		rv[ix] = v.Index(ix).Interface()
+	}
+	return rv, nil
+}
+
+// join joins the elements of any list with sep.
+func join(sep string, list interface{}) (string, error) {
+	items, err := toList(list)
+	if err != nil {
+		return "", err
+	}
+	strs := make([]string, len(items))
+	for ix, item := range items {
+		strs[ix] = fmt.Sprint(item)
+	}
+	return strings.Join(strs, sep), nil
+}
+
+// regexQuote escapes all regular expression metacharacters in s, then
+// escapes the result so it can be placed in a double-quoted PromQL
+// string, such as the value of a =~ matcher.
+func regexQuote(s interface{}) string {
+	quoted := regexp.QuoteMeta(fmt.Sprint(s))
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(quoted)
+}
+
+// regexAlternation returns a regular expression matching exactly the
+// elements of a list, escaped for use in a double-quoted PromQL
+// string.
+func regexAlternation(list interface{}) (string, error) {
+	items, err := toList(list)
+	if err != nil {
+		return "", err
+	}
+	strs := make([]string, len(items))
+	for ix, item := range items {
+		strs[ix] = regexQuote(item)
+	}
+	return strings.Join(strs, "|"), nil
+}
+
+// empty reports whether a value is nil or the zero value of its type,
+// or an empty list or map.
+func empty(val interface{}) bool {
+	if val == nil {
+		return true
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return v.Len() == 0
+	}
+	return reflect.DeepEqual(val, reflect.Zero(v.Type()).Interface())
+}
+
+// defaultValue returns val, unless it is empty, in which case def is
+// returned.
+func defaultValue(def, val interface{}) interface{} {
+	if empty(val) {
+		return def
+	}
+	return val
+}
+
+// required returns val, or fails template expansion with msg if val
+// is empty.
+func required(msg string, val interface{}) (interface{}, error) {
+	if empty(val) {
+		return nil, errors.New(msg)
+	}
+	return val, nil
+}
+
+// toFloat converts any number, or string containing a number, to a
+// float64.
+func toFloat(val interface{}) (float64, error) {
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return strconv.ParseFloat(v.String(), 64)
+	}
+	return 0, fmt.Errorf("expected a number, got %T", val)
+}
+
+// toInt converts any number, or string containing a number, to an
+// int, truncating towards zero.
+func toInt(val interface{}) (int, error) {
+	f, err := toFloat(val)
+	return int(f), err
+}
+
+// isInt reports whether val is of an integer type.
+func isInt(val interface{}) bool {
+	switch reflect.ValueOf(val).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// arithmetic applies op to a and b. If both are integers, so is the
+// result (except for div), otherwise it is a float64.
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return nil, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv float64
+	switch op {
+	case "add":
+		rv = x + y
+	case "sub":
+		rv = x - y
+	case "mul":
+		rv = x * y
+	case "div":
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return x / y, nil
+	case "mod":
+		if !isInt(a) || !isInt(b) {
+			return nil, errors.New("mod needs integer arguments")
+		}
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return int(x) % int(y), nil
+	}
+
+	if isInt(a) && isInt(b) {
+		return int(rv), nil
+	}
+	return rv, nil
+}
+
+// extreme returns the largest (op "max") or smallest (op "min") of its
+// arguments, unchanged.
+func extreme(op string, first interface{}, rest []interface{}) (interface{}, error) {
+	best := first
+	bestVal, err := toFloat(first)
+	if err != nil {
+		return nil, err
+	}
+	for _, val := range rest {
+		f, err := toFloat(val)
+		if err != nil {
+			return nil, err
+		}
+		if (op == "max" && f > bestVal) || (op == "min" && f < bestVal) {
+			best, bestVal = val, f
+		}
+	}
+	return best, nil
+}
+
+// durationSeconds parses a prometheus duration, such as "5m" or "1d",
+// returning the number of seconds it represents.
+func durationSeconds(s string) (float64, error) {
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(d).Seconds(), nil
+}
+
+// formatDuration formats a number of seconds as a prometheus duration.
+func formatDuration(seconds interface{}) (string, error) {
+	f, err := toFloat(seconds)
+	if err != nil {
+		return "", err
+	}
+	return model.Duration(time.Duration(f * float64(time.Second))).String(), nil
+}
+
+// dict builds a map from alternating keys and values.
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict needs an even number of arguments")
+	}
+	rv := make(map[string]interface{})
+	for ix := 0; ix < len(pairs); ix += 2 {
+		rv[fmt.Sprint(pairs[ix])] = pairs[ix+1]
+	}
+	return rv, nil
+}
+
+// keys returns the keys of a map, sorted.
+func keys(m map[string]interface{}) []string {
+	rv := make([]string, 0, len(m))
+	for key := range m {
+		rv = append(rv, key)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// has reports whether a list contains an element. The list comes last,
+// as in sprig, so it can be piped in.
+func has(elem interface{}, list interface{}) (bool, error) {
+	items, err := toList(list)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range items {
+		if reflect.DeepEqual(item, elem) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// concat joins several lists into one.
+func concat(lists ...interface{}) ([]interface{}, error) {
+	var rv []interface{}
+	for _, list := range lists {
+		items, err := toList(list)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, items...)
+	}
+	return rv, nil
+}
+
+// toYaml renders a value as YAML, without a trailing newline.
+func toYaml(val interface{}) (string, error) {
+	buf, err := yaml.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(buf), "\n"), nil
+}
+
+// indent prefixes every line of s with n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
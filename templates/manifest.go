@@ -0,0 +1,197 @@
+package templates
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/G-Research/prometheus-config-loader/strictyaml"
+)
+
+// ManifestFile is the name of the optional context manifest, at the
+// top of a source directory.
+const ManifestFile = "contexts.yaml"
+
+// Manifest describes the contexts rules are expanded for. Every
+// context has a set of labels, such as region or hardware class. The
+// values of the labels named in Layers are the names of the groups the
+// context is in, and the values from <group>.vars are layered between
+// default.vars and <context>.vars, in the order given in Layers.
+type Manifest struct {
+	Layers   []string                     `yaml:"layers"`
+	Contexts map[string]map[string]string `yaml:"contexts"`
+}
+
+// The labels of a context in the manifest that, if set, give the
+// namespace and prometheus its rules are uploaded for, the ruler and
+// tenant they are uploaded to, the prometheus to reload afterwards, or
+// the template the PrometheusRules are named by.
+const (
+	NamespaceLabel     = "namespace"
+	PrometheusLabel    = "prometheus"
+	RulerURLLabel      = "ruler_url"
+	TenantLabel        = "tenant"
+	PrometheusURLLabel = "prometheus_url"
+	NameTemplateLabel  = "name_template"
+)
+
+// LoadManifest reads the context manifest from a source directory. If
+// there is no manifest, nil is returned, with no error.
+func LoadManifest(directory string, opts Options) (*Manifest, error) {
+	name := filepath.Join(directory, ManifestFile)
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(name, data, opts.Strict)
+}
+
+// parseManifest parses and validates a context manifest, the file name
+// is only used for error messages.
+func parseManifest(name string, data []byte, strict bool) (*Manifest, error) {
+	var rv Manifest
+	err := strictyaml.Unmarshal(name, data, &rv, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range rv.Layers {
+		if layer == "" {
+			return nil, fmt.Errorf("%s: layer names must not be empty", name)
+		}
+	}
+	for _, context := range sortedContexts(rv.Contexts) {
+		for _, group := range rv.Groups(context) {
+			if group == "default" {
+				return nil, fmt.Errorf("%s: context %s: group must not be named default", name, context)
+			}
+			if _, ok := rv.Contexts[group]; ok {
+				return nil, fmt.Errorf("%s: context %s: group %s has the same name as a context", name, context, group)
+			}
+		}
+	}
+
+	return &rv, nil
+}
+
+// Groups returns the groups a context is in, in layering order. A nil
+// Manifest has no groups.
+func (m *Manifest) Groups(context string) []string {
+	if m == nil {
+		return nil
+	}
+	var rv []string
+	for _, layer := range m.Layers {
+		if group := m.Contexts[context][layer]; group != "" {
+			rv = append(rv, group)
+		}
+	}
+	return rv
+}
+
+// Select resolves a list of names and a label selector into a list of
+// contexts. Each name is either a context, or the name of a group,
+// which selects all contexts in the group. The selector, if not empty,
+// selects all contexts whose labels match it. Names that are neither
+// a context nor a group in the manifest are taken to be contexts, so
+// contexts need not be listed in the manifest. Each context is only
+// returned once.
+func (m *Manifest) Select(names []string, selector string) ([]string, error) {
+	var rv []string
+	seen := make(map[string]bool)
+	add := func(context string) {
+		if !seen[context] {
+			seen[context] = true
+			rv = append(rv, context)
+		}
+	}
+
+	var contexts []string
+	if m != nil {
+		contexts = sortedContexts(m.Contexts)
+	}
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if _, ok := m.context(name); ok || !m.isGroup(name) {
+			add(name)
+			continue
+		}
+		for _, context := range contexts {
+			for _, group := range m.Groups(context) {
+				if group == name {
+					add(context)
+				}
+			}
+		}
+	}
+
+	if selector != "" {
+		if m == nil {
+			return nil, fmt.Errorf("selecting contexts by label needs a %s", ManifestFile)
+		}
+		sel, err := labels.Parse(selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse context selector %q: %s", selector, err)
+		}
+		for _, context := range contexts {
+			if sel.Matches(labels.Set(m.Contexts[context])) {
+				add(context)
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// Label returns the value of a label for a context, or the empty string
+// if it is not set. A nil Manifest has no labels.
+func (m *Manifest) Label(context, name string) string {
+	labels, _ := m.context(context)
+	return labels[name]
+}
+
+// context returns the labels of a context, and whether the context is
+// in the manifest.
+func (m *Manifest) context(name string) (map[string]string, bool) {
+	if m == nil {
+		return nil, false
+	}
+	rv, ok := m.Contexts[name]
+	return rv, ok
+}
+
+// isGroup reports whether any context is in the named group.
+func (m *Manifest) isGroup(name string) bool {
+	if m == nil {
+		return false
+	}
+	for context := range m.Contexts {
+		for _, group := range m.Groups(context) {
+			if group == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sortedContexts returns the context names of a manifest in sorted
+// order.
+func sortedContexts(contexts map[string]map[string]string) []string {
+	var rv []string
+	for name := range contexts {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
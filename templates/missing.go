@@ -0,0 +1,250 @@
+package templates
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"text/template"
+	"text/template/parse"
+)
+
+// optionalFunc is the function that optional value lookups are
+// rewritten to call, see rewriteOptional.
+const optionalFunc = "_optional"
+
+// optional looks up path under val, as a field reference such as
+// .Values.threshold does, but returns nil rather than failing if any
+// part of it is missing.
+func optional(val interface{}, path ...string) interface{} {
+	for _, key := range path {
+		next, found, err := lookupKey(val, key)
+		if err != nil || !found {
+			return nil
+		}
+		val = next
+	}
+	return val
+}
+
+// lookupKey returns the field or map entry key of val, and whether it
+// has one. It fails if val is neither a struct nor a map with string
+// keys.
+func lookupKey(val interface{}, key string) (interface{}, bool, error) {
+	v := reflect.ValueOf(val)
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, false, fmt.Errorf("nil has no field %s", key)
+		}
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.Struct:
+		field, ok := v.Type().FieldByName(key)
+		if !ok || field.PkgPath != "" {
+			return nil, false, nil
+		}
+		return v.FieldByIndex(field.Index).Interface(), true, nil
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		elem := v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))
+		if !elem.IsValid() {
+			return nil, false, nil
+		}
+		return elem.Interface(), true, nil
+	}
+	return nil, false, fmt.Errorf("%s has no field %s", v.Type(), key)
+}
+
+// rewriteOptional rewrites the field references given to default and
+// required in every template of tmpl, such as .Values.threshold in
+// `.Values.threshold | default 80` or `default 80 .Values.threshold`,
+// to look the value up with optional. Otherwise, with missingkey=error,
+// a missing value fails before default or required see it.
+func rewriteOptional(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			rewriteNode(t.Tree.Root)
+		}
+	}
+}
+
+// rewriteNode applies rewriteOptional to a node and everything in it.
+func rewriteNode(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			rewriteNode(child)
+		}
+	case *parse.ActionNode:
+		rewritePipe(n.Pipe)
+	case *parse.IfNode:
+		rewriteBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		rewriteBranch(&n.BranchNode)
+	case *parse.WithNode:
+		rewriteBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		rewritePipe(n.Pipe)
+	}
+}
+
+// rewriteBranch applies rewriteOptional to an if, range or with.
+func rewriteBranch(n *parse.BranchNode) {
+	rewritePipe(n.Pipe)
+	rewriteNode(n.List)
+	rewriteNode(n.ElseList)
+}
+
+// rewritePipe applies rewriteOptional to a pipeline.
+func rewritePipe(pipe *parse.PipeNode) {
+	if pipe == nil {
+		return
+	}
+	for ix, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch a := arg.(type) {
+			case *parse.PipeNode:
+				rewritePipe(a)
+			case *parse.ChainNode:
+				if p, ok := a.Node.(*parse.PipeNode); ok {
+					rewritePipe(p)
+				}
+			}
+		}
+
+		fn, ok := cmd.Args[0].(*parse.IdentifierNode)
+		if !ok || (fn.Ident != "default" && fn.Ident != "required") {
+			continue
+		}
+		switch {
+		case len(cmd.Args) == 3:
+			if lookup := optionalCommand(cmd.Args[2]); lookup != nil {
+				cmd.Args[2] = &parse.PipeNode{NodeType: parse.NodePipe, Pos: lookup.Pos, Cmds: []*parse.CommandNode{lookup}}
+			}
+		case len(cmd.Args) == 2 && ix > 0 && len(pipe.Cmds[ix-1].Args) == 1:
+			if lookup := optionalCommand(pipe.Cmds[ix-1].Args[0]); lookup != nil {
+				pipe.Cmds[ix-1] = lookup
+			}
+		}
+	}
+}
+
+// optionalCommand returns a command calling optional for a field
+// reference, such as .Values.threshold or $.Values.threshold, or nil
+// for anything else.
+func optionalCommand(node parse.Node) *parse.CommandNode {
+	var root parse.Node
+	var path []string
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		root = &parse.DotNode{NodeType: parse.NodeDot, Pos: n.Pos}
+		path = n.Ident
+	case *parse.VariableNode:
+		if len(n.Ident) < 2 {
+			return nil
+		}
+		root = &parse.VariableNode{NodeType: parse.NodeVariable, Pos: n.Pos, Ident: n.Ident[:1]}
+		path = n.Ident[1:]
+	default:
+		return nil
+	}
+
+	pos := node.Position()
+	args := []parse.Node{parse.NewIdentifier(optionalFunc).SetPos(pos), root}
+	for _, key := range path {
+		args = append(args, &parse.StringNode{NodeType: parse.NodeString, Pos: pos, Quoted: strconv.Quote(key), Text: key})
+	}
+	return &parse.CommandNode{NodeType: parse.NodeCommand, Pos: pos, Args: args}
+}
+
+// missingKeys returns an error for every reference to a value missing
+// from data in tmpl, worded as text/template words them. Executing a
+// template stops at the first error, this finds them all, but only
+// looks at what is always executed: the top level of the template,
+// and the conditions of if, range and with, not their bodies.
+func missingKeys(tmpl *template.Template, data interface{}) []error {
+	if tmpl.Tree == nil {
+		return nil
+	}
+	m := missingKeyFinder{tmpl: tmpl, data: data}
+	for _, node := range tmpl.Tree.Root.Nodes {
+		switch n := node.(type) {
+		case *parse.ActionNode:
+			m.pipe(n.Pipe)
+		case *parse.IfNode:
+			m.pipe(n.Pipe)
+		case *parse.RangeNode:
+			m.pipe(n.Pipe)
+		case *parse.WithNode:
+			m.pipe(n.Pipe)
+		case *parse.TemplateNode:
+			m.pipe(n.Pipe)
+		}
+	}
+	return m.errs
+}
+
+// missingKeyFinder collects the errors for missingKeys.
+type missingKeyFinder struct {
+	tmpl *template.Template
+	data interface{}
+	errs []error
+}
+
+// pipe checks every command of a pipeline. The arguments of and and
+// or after the first are not always evaluated, so they are skipped.
+func (m *missingKeyFinder) pipe(pipe *parse.PipeNode) {
+	if pipe == nil {
+		return
+	}
+	for _, cmd := range pipe.Cmds {
+		args := cmd.Args
+		if fn, ok := args[0].(*parse.IdentifierNode); ok && (fn.Ident == "and" || fn.Ident == "or") && len(args) > 2 {
+			args = args[:2]
+		}
+		for _, arg := range args {
+			m.arg(arg)
+		}
+	}
+}
+
+// arg checks a single argument of a command.
+func (m *missingKeyFinder) arg(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		m.path(n, n.Ident)
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" {
+			m.path(n, n.Ident[1:])
+		}
+	case *parse.PipeNode:
+		m.pipe(n)
+	case *parse.ChainNode:
+		if p, ok := n.Node.(*parse.PipeNode); ok {
+			m.pipe(p)
+		}
+	}
+}
+
+// path looks up a field reference starting from the data, recording an
+// error if a map along the way has no entry for it. Anything else that
+// would go wrong is left for executing the template to report.
+func (m *missingKeyFinder) path(node parse.Node, path []string) {
+	val := m.data
+	for _, key := range path {
+		next, found, err := lookupKey(val, key)
+		if err != nil {
+			return
+		}
+		if !found {
+			if reflect.Indirect(reflect.ValueOf(val)).Kind() == reflect.Map {
+				location, context := m.tmpl.ErrorContext(node)
+				m.errs = append(m.errs, fmt.Errorf("template: %s: executing %q at <%s>: map has no entry for key %q", location, m.tmpl.Name(), context, key))
+			}
+			return
+		}
+		val = next
+	}
+}
@@ -1,14 +1,18 @@
 package templates
 
 import (
+	"bytes"
 	"fmt"
-	yaml "gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
+
+	"github.com/G-Research/prometheus-config-loader/cfgloader/rulefmt"
+	"github.com/G-Research/prometheus-config-loader/strictyaml"
 )
 
 // TemplateData contains various information about template expansions
@@ -18,23 +22,44 @@ type TemplateData struct {
 	// Name of the base directory for this expansion
 	Directory string
 	// A list of all files that exist in the directory, uni tests
-	// are prefixed with the string "tests/"
+	// are in directories named "tests"
 	Files []string
+	// The values used for expanding templates at the top of the
+	// directory
+	Values Values
 }
 
 // Values is a data structure that encapsulates the variables from a
-// settings file.
+// settings file. Values can be any YAML structure, nested maps always
+// have string keys.
 type Values struct {
-	Values map[string]string
+	Values map[string]interface{}
 }
 
-// internalTemplate packages up the templates and variables for a directory.
+// A key ending in appendSuffix appends its list to the list of the
+// same name (without the suffix) when merging values, rather than
+// replacing it.
+const appendSuffix = "+"
+
+// internalTemplate packages up the templates and variables for a
+// directory tree. Templates and test files are recorded by their path
+// relative to the top of the tree, variables by the relative directory
+// they were found in (the top of the tree itself being ".") and then
+// by context.
 type internalTemplate struct {
-	variables map[string]Values
+	variables map[string]map[string]Values
 	templates map[string]*template.Template
-	sourceDir string
+	testFiles []string
+	// Only set if ExpandTests is set
+	testTemplates map[string]*template.Template
+	sourceDir     string
+	manifest      *Manifest
+	opts          Options
 }
 
+// Name of the directories containing unit tests.
+const testDirectory = "tests"
+
 // ExpansionData is simply a map from "context name" to a TemplateData
 // structure containing the relevant information for the expanded
 // templates for that context.
@@ -43,78 +68,227 @@ type ExpansionData map[string]TemplateData
 // Default directory for template expansion output directories.
 var DefaultTempDirectory = "/tmp/prometheus-config-loader"
 
+// Options controls how a source directory is read and expanded.
+type Options struct {
+	// If set, variables files, unit test files and the context
+	// manifest are rejected if they have unknown fields or duplicate
+	// keys
+	Strict bool
+	// If set, unit test files are template-expanded like rule files,
+	// rather than being copied as they are
+	ExpandTests bool
+	// If set, templates referring to values that are not set expand to
+	// "<no value>", rather than failing
+	AllowMissingValues bool
+}
+
+// ExpansionErrors collects all template execution errors from
+// expanding one or more contexts.
+type ExpansionErrors []error
+
+func (e ExpansionErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
 // ExpandDirectory takes a list of context names and a base directory,
 // then calls expandDirectory for each context, collating all the data
 // and returning it.
-func ExpandDirectory(contexts []string, sourceDirectory string) (ExpansionData, error) {
+//
+// Template execution errors, such as references to values that are
+// not set, do not stop the expansion. Instead, they are collected for
+// all contexts and returned as ExpansionErrors.
+func ExpandDirectory(contexts []string, sourceDirectory string, opts Options) (ExpansionData, error) {
 	rv := make(ExpansionData)
+	var errs ExpansionErrors
 
-	templates, err := createInternalTemplate(sourceDirectory)
+	templates, err := createInternalTemplate(sourceDirectory, opts)
 	if err != nil {
 		return rv, err
 	}
 	for _, context := range contexts {
 		data, err := expandDirectory(context, templates)
-		if err != nil {
+		if execErrs, ok := err.(ExpansionErrors); ok {
+			errs = append(errs, execErrs...)
+		} else if err != nil {
 			return nil, err
 		}
 		rv[context] = data
 	}
 
+	if len(errs) > 0 {
+		return rv, errs
+	}
 	return rv, nil
 }
 
-// createInternalTemplate parses all templates in a directory, reads
-// all the variables settings and returns a structure encapsulating
-// these in a form suitable for later consumption.
-func createInternalTemplate(directory string) (internalTemplate, error) {
-	rv := internalTemplate{sourceDir: directory}
+// createInternalTemplate parses all templates in a directory tree,
+// reads all the variables settings and returns a structure
+// encapsulating these in a form suitable for later consumption. Any
+// directory named "tests" is taken to contain unit tests.
+func createInternalTemplate(directory string, opts Options) (internalTemplate, error) {
+	rv := internalTemplate{sourceDir: directory, opts: opts}
 	rv.templates = make(map[string]*template.Template)
-	rv.variables = make(map[string]Values)
+	rv.testTemplates = make(map[string]*template.Template)
+	rv.variables = make(map[string]map[string]Values)
 
-	names, err := filepath.Glob(filepath.Join(directory, "*.vars"))
+	manifest, err := LoadManifest(directory, opts)
 	if err != nil {
 		return rv, err
 	}
-	for _, name := range names {
-		context, values, err := readValues(name)
+	rv.manifest = manifest
+
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return rv, err
+			return err
 		}
-		rv.variables[context] = values
-	}
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || rel == ManifestFile {
+			return nil
+		}
+
+		switch {
+		case IsTestFile(rel):
+			if filepath.Ext(rel) != ".yaml" {
+				return nil
+			}
+			rv.testFiles = append(rv.testFiles, rel)
+			if opts.ExpandTests {
+				tmpl, err := parseTemplate(path, rel, opts)
+				if err != nil {
+					return err
+				}
+				rv.testTemplates[rel] = tmpl
+			}
+		case filepath.Ext(rel) == ".vars":
+			context, values, err := readValues(path, opts.Strict)
+			if err != nil {
+				return err
+			}
+			dir := filepath.Dir(rel)
+			if rv.variables[dir] == nil {
+				rv.variables[dir] = make(map[string]Values)
+			}
+			rv.variables[dir][context] = values
+		case filepath.Ext(rel) == ".yaml":
+			tmpl, err := parseTemplate(path, rel, opts)
+			if err != nil {
+				return err
+			}
+			rv.templates[rel] = tmpl
+		}
+		return nil
+	})
 
-	names, err = filepath.Glob(filepath.Join(directory, "*.yaml"))
+	return rv, err
+}
+
+// parseTemplate parses the file at path as a template, named after its
+// path relative to the top of the source directory. Values given to
+// default and required may be missing, see rewriteOptional.
+func parseTemplate(path, rel string, opts Options) (*template.Template, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return rv, err
+		return nil, err
 	}
-	for _, name := range names {
-		base := filepath.Base(name)
-		tmpl := template.New(base).Delims("<{[", "]}>")
-		tmpl, err := tmpl.ParseFiles(name)
-		if err != nil {
-			return rv, err
+	tmpl, err := template.New(rel).Delims("<{[", "]}>").Funcs(funcMap()).Option(missingKeyOption(opts)).Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	rewriteOptional(tmpl)
+	return tmpl, nil
+}
+
+// executeTemplate expands tmpl with values into out. Unless missing
+// values are allowed, all references to missing values that
+// missingKeys finds are returned, without expanding anything, as
+// executing the template would only report the first.
+func executeTemplate(out io.Writer, tmpl *template.Template, values Values, opts Options) []error {
+	if !opts.AllowMissingValues {
+		if errs := missingKeys(tmpl, values); len(errs) > 0 {
+			return errs
+		}
+	}
+	if err := tmpl.Execute(out, values); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// IsTestFile reports whether a file, given by its path relative to the
+// top of a source or expansion directory, is a unit test file.
+func IsTestFile(rel string) bool {
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == testDirectory {
+			return true
 		}
-		rv.templates[base] = tmpl
 	}
+	return false
+}
 
-	return rv, nil
+// missingKeyOption returns the template option for handling references
+// to values that are not set.
+func missingKeyOption(opts Options) string {
+	if opts.AllowMissingValues {
+		return "missingkey=default"
+	}
+	return "missingkey=error"
 }
 
 // getVariables returns the context-specific Values struct for a
-// specific context (or an empty Values, of no named context exists).
-func (i internalTemplate) getVariables(context string) Values {
-	rv, ok := i.variables[context]
+// specific directory and context (or an empty Values, of no named
+// context exists).
+func (i internalTemplate) getVariables(dir, context string) Values {
+	rv, ok := i.variables[dir][context]
 	if ok {
 		return rv
 	}
 	return Values{}
 }
 
+// valuesFor returns the values for expanding the templates in a
+// directory. Starting from the top of the tree and working down to the
+// directory itself, default.vars, then <group>.vars for each group the
+// context is in and finally <context>.vars from each directory are
+// layered on top of everything above them.
+func (i internalTemplate) valuesFor(dir, context string) Values {
+	var layers []Values
+	for _, d := range parentDirs(dir) {
+		layers = append(layers, i.getVariables(d, "default"))
+		for _, group := range i.manifest.Groups(context) {
+			layers = append(layers, i.getVariables(d, group))
+		}
+		layers = append(layers, i.getVariables(d, context))
+	}
+	rv := mergeValues(layers...)
+	rv.Values["context"] = context
+	return rv
+}
+
+// parentDirs returns all directories from the top of the tree down to
+// dir, e.g. ".", "a" and "a/b" for "a/b".
+func parentDirs(dir string) []string {
+	rv := []string{"."}
+	if dir == "." {
+		return rv
+	}
+	parts := strings.Split(dir, string(filepath.Separator))
+	for ix := range parts {
+		rv = append(rv, filepath.Join(parts[:ix+1]...))
+	}
+	return rv
+}
+
 // readValues reads a context variables file, returning the context
 // name, a values containing the parsed variables and an error if one
 // occurs.
-func readValues(name string) (string, Values, error) {
+func readValues(name string, strict bool) (string, Values, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return "", Values{}, err
@@ -126,37 +300,101 @@ func readValues(name string) (string, Values, error) {
 		return "", Values{}, err
 	}
 
-	return parseValues(name, data)
+	return parseValues(name, data, strict)
 }
 
 // parseValues expects YAML data in a []byte and returns the parsed
 // version. If an error is returned, nil and the error from
-// yaml.Unmarshal is returned.
-func parseValues(name string, data []byte) (string, Values, error) {
-	name = filepath.Base(name)
+// strictyaml.Unmarshal is returned.
+func parseValues(path string, data []byte, strict bool) (string, Values, error) {
+	name := filepath.Base(path)
 	extStart := strings.Index(name, ".vars")
 	if extStart >= 0 {
 		name = name[:extStart]
 	}
-	rv := Values{Values: make(map[string]string)}
-	err := yaml.Unmarshal(data, &rv.Values)
+	raw := make(map[string]interface{})
+	err := strictyaml.Unmarshal(path, data, &raw, strict)
 	if err != nil {
 		return name, Values{}, err
 	}
 
-	return name, rv, nil
+	return name, Values{Values: normaliseMap(raw)}, nil
 }
 
-// mergeValues merges two Values dictionaries, letting anything set in
-// the second override anything set in the first.
-func mergeValues(first, second Values) Values {
-	rv := Values{Values: make(map[string]string)}
+// normaliseValue converts the map[interface{}]interface{} values the
+// YAML decoder produces into map[string]interface{}, recursively.
+func normaliseValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		rv := make(map[string]interface{})
+		for key, elem := range v {
+			rv[fmt.Sprint(key)] = normaliseValue(elem)
+		}
+		return rv
+	case map[string]interface{}:
+		return normaliseMap(v)
+	case []interface{}:
+		rv := make([]interface{}, len(v))
+		for ix, elem := range v {
+			rv[ix] = normaliseValue(elem)
+		}
+		return rv
+	}
+	return val
+}
 
-	for key, val := range first.Values {
-		rv.Values[key] = val
+// normaliseMap applies normaliseValue to every value in a map.
+func normaliseMap(m map[string]interface{}) map[string]interface{} {
+	rv := make(map[string]interface{})
+	for key, val := range m {
+		rv[key] = normaliseValue(val)
 	}
-	for key, val := range second.Values {
-		rv.Values[key] = val
+	return rv
+}
+
+// mergeValues merges Values dictionaries, letting anything set in a
+// later one override anything set in an earlier one. Maps are merged
+// recursively, lists are replaced unless the overriding key ends in
+// appendSuffix, in which case they are appended.
+func mergeValues(layers ...Values) Values {
+	rv := Values{Values: make(map[string]interface{})}
+	for _, layer := range layers {
+		rv.Values = mergeMaps(rv.Values, layer.Values)
+	}
+	return rv
+}
+
+// mergeMaps returns a new map with second merged into first, neither
+// of the arguments is modified.
+func mergeMaps(first, second map[string]interface{}) map[string]interface{} {
+	rv := make(map[string]interface{})
+	for key, val := range first {
+		rv[key] = val
+	}
+
+	for key, val := range second {
+		if strings.HasSuffix(key, appendSuffix) {
+			key = strings.TrimSuffix(key, appendSuffix)
+			existing, okExisting := rv[key].([]interface{})
+			extra, okExtra := val.([]interface{})
+			if okExisting && okExtra {
+				merged := make([]interface{}, 0, len(existing)+len(extra))
+				merged = append(merged, existing...)
+				rv[key] = append(merged, extra...)
+				continue
+			}
+		}
+		existing, okExisting := rv[key].(map[string]interface{})
+		override, okOverride := val.(map[string]interface{})
+		switch {
+		case okExisting && okOverride:
+			rv[key] = mergeMaps(existing, override)
+		case okOverride:
+			// Resolve any append markers in nested maps
+			rv[key] = mergeMaps(nil, override)
+		default:
+			rv[key] = val
+		}
 	}
 
 	return rv
@@ -177,17 +415,19 @@ func mktemp(base, leaf string) (string, error) {
 }
 
 // expandDirectory takes a context name, and an internalTemplate
-// structure, then proceeds to create an output directory, read the
-// context-specific configuration (first by reading the file
-// default.vars (if it exists) and then <context>.vars (overriding any
-// variables set from the default) and template-expanding the files
-// matching *.yaml into the output directory.
+// structure, then proceeds to create an output directory mirroring the
+// source tree and template-expand every *.yaml file into it. The
+// values for a template are built from the default.vars, group and
+// <context>.vars files in the directory of the template and in every
+// directory above it, as described for valuesFor.
+// Errors from executing the templates are collected, and returned as
+// ExpansionErrors once all files have been expanded.
 //
-// Once that is complete, it will simply copy files matching
-// tests/*.yaml into the tests/ subdirectory of the output directory.
+// Once that is complete, it will copy the files from all tests/
+// directories into the same place in the output directory, expanding
+// them first if ExpandTests is set and checking their structure if
+// Strict is set, see Options.
 func expandDirectory(context string, data internalTemplate) (TemplateData, error) {
-	values := mergeValues(data.getVariables("default"), data.getVariables(context))
-	values.Values["context"] = context
 	rv := TemplateData{}
 
 	outDir, err := mktemp(DefaultTempDirectory, fmt.Sprintf("tmp-%s-", context))
@@ -196,40 +436,72 @@ func expandDirectory(context string, data internalTemplate) (TemplateData, error
 	}
 	rv.Directory = outDir
 	rv.Context = context
+	rv.Values = data.valuesFor(".", context)
 
-	for filename, tpl := range data.templates {
-		out, err := os.Create(filepath.Join(outDir, filename))
+	var errs ExpansionErrors
+	var filenames []string
+	for filename := range data.templates {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		path := filepath.Join(outDir, filename)
+		err := os.MkdirAll(filepath.Dir(path), 0777)
 		if err != nil {
 			return rv, err
 		}
-		defer out.Close()
-		rv.Files = append(rv.Files, filename)
-		err = tpl.Execute(out, values)
+		out, err := os.Create(path)
 		if err != nil {
 			return rv, err
 		}
+		rv.Files = append(rv.Files, filename)
+		execErrs := executeTemplate(out, data.templates[filename], data.valuesFor(filepath.Dir(filename), context), data.opts)
+		out.Close()
+		for _, err := range execErrs {
+			errs = append(errs, fmt.Errorf("context %s: %s", context, err))
+		}
 	}
 
-	os.Mkdir(filepath.Join(outDir, "tests"), 0777)
-	testFiles, err := filepath.Glob(filepath.Join(data.sourceDir, "tests", "*.yaml"))
-	if err != nil {
-		return rv, err
-	}
-	for _, file := range testFiles {
-		source, err := os.Open(file)
-		defer source.Close()
+	os.Mkdir(filepath.Join(outDir, testDirectory), 0777)
+	for _, filename := range data.testFiles {
+		file := filepath.Join(data.sourceDir, filename)
+		tmpl := data.testTemplates[filename]
+		values := data.valuesFor(filepath.Dir(filename), context)
+		raw, err := ioutil.ReadFile(file)
 		if err != nil {
 			return rv, err
 		}
-		sink, err := os.Create(filepath.Join(outDir, "tests", filepath.Base(file)))
-		defer sink.Close()
+		if tmpl != nil {
+			var buf bytes.Buffer
+			if execErrs := executeTemplate(&buf, tmpl, values, data.opts); len(execErrs) > 0 {
+				for _, err := range execErrs {
+					errs = append(errs, fmt.Errorf("context %s: %s", context, err))
+				}
+				continue
+			}
+			raw = buf.Bytes()
+		}
+		if data.opts.Strict {
+			err = strictyaml.Check(file, raw, &rulefmt.UnitTestFile{})
+			if err != nil {
+				return rv, err
+			}
+		}
+		path := filepath.Join(outDir, filename)
+		err = os.MkdirAll(filepath.Dir(path), 0777)
 		if err != nil {
 			return rv, err
 		}
-		io.Copy(sink, source)
-		rv.Files = append(rv.Files, filepath.Join("tests", filepath.Base(file)))
+		err = ioutil.WriteFile(path, raw, 0666)
+		if err != nil {
+			return rv, err
+		}
+		rv.Files = append(rv.Files, filename)
 	}
 
+	if len(errs) > 0 {
+		return rv, errs
+	}
 	return rv, nil
 }
 
@@ -1,38 +1,20 @@
 package templates
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"text/template"
 )
 
 func compareValues(expected, seen Values) bool {
-	if len(expected.Values) != len(seen.Values) {
-		return false
-	}
-
-	for key, expectedVal := range expected.Values {
-		seenVal, ok := seen.Values[key]
-		if !ok {
-			return false
-		}
-		if seenVal != expectedVal {
-			return false
-		}
-	}
-	for key, seenVal := range seen.Values {
-		expectedVal, ok := expected.Values[key]
-		if !ok {
-			return false
-		}
-		if seenVal != expectedVal {
-			return false
-		}
-	}
-	return true
+	return reflect.DeepEqual(expected.Values, seen.Values)
 }
 
 func TestParseValues(t *testing.T) {
@@ -42,20 +24,27 @@ func TestParseValues(t *testing.T) {
 	}{
 		{
 			[]byte(""),
-			Values{Values: map[string]string{}},
+			Values{Values: map[string]interface{}{}},
 		},
 		{
 			[]byte("foo: hello"),
-			Values{Values: map[string]string{"foo": "hello"}},
+			Values{Values: map[string]interface{}{"foo": "hello"}},
 		},
 		{
 			[]byte("foo: 7.3"),
-			Values{Values: map[string]string{"foo": "7.3"}},
+			Values{Values: map[string]interface{}{"foo": 7.3}},
+		},
+		{
+			[]byte("foo: [a, b]\nbar:\n  baz: 3\n  4: four\n"),
+			Values{Values: map[string]interface{}{
+				"foo": []interface{}{"a", "b"},
+				"bar": map[string]interface{}{"baz": 3, "4": "four"},
+			}},
 		},
 	}
 
 	for ix, test := range td {
-		_, seen, err := parseValues("./test.vars", test.yaml)
+		_, seen, err := parseValues("./test.vars", test.yaml, true)
 		if err != nil {
 			t.Errorf("Test case %d, error: %s", ix, err)
 		}
@@ -65,16 +54,33 @@ func TestParseValues(t *testing.T) {
 	}
 }
 
+func TestParseValuesStrict(t *testing.T) {
+	data := []byte("foo: hello\nbar: 1\nfoo: again\n")
+
+	_, _, err := parseValues("./test.vars", data, true)
+	if err == nil {
+		t.Errorf("Expected duplicate key to fail in strict mode")
+	}
+
+	_, seen, err := parseValues("./test.vars", data, false)
+	if err != nil {
+		t.Errorf("Unexpected error in non-strict mode, %s", err)
+	}
+	if seen.Values["foo"] != "again" {
+		t.Errorf("Expected the last value to win in non-strict mode, saw %s", seen.Values["foo"])
+	}
+}
+
 func TestComposeValues(t *testing.T) {
-	a := Values{Values: map[string]string{
+	a := Values{Values: map[string]interface{}{
 		"a": "foo",
 		"b": "bar",
 		"c": "xyzzy",
 	}}
-	b := Values{Values: map[string]string{
+	b := Values{Values: map[string]interface{}{
 		"b": "overridden",
 	}}
-	c := Values{Values: map[string]string{
+	c := Values{Values: map[string]interface{}{
 		"c": "overridden",
 	}}
 
@@ -83,9 +89,9 @@ func TestComposeValues(t *testing.T) {
 		second   Values
 		expected Values
 	}{
-		{a, b, Values{Values: map[string]string{"a": "foo", "b": "overridden", "c": "xyzzy"}}},
-		{a, c, Values{Values: map[string]string{"a": "foo", "b": "bar", "c": "overridden"}}},
-		{b, c, Values{Values: map[string]string{"b": "overridden", "c": "overridden"}}},
+		{a, b, Values{Values: map[string]interface{}{"a": "foo", "b": "overridden", "c": "xyzzy"}}},
+		{a, c, Values{Values: map[string]interface{}{"a": "foo", "b": "bar", "c": "overridden"}}},
+		{b, c, Values{Values: map[string]interface{}{"b": "overridden", "c": "overridden"}}},
 	}
 
 	for ix, test := range cases {
@@ -96,6 +102,69 @@ func TestComposeValues(t *testing.T) {
 	}
 }
 
+func TestComposeNestedValues(t *testing.T) {
+	defaults := Values{Values: map[string]interface{}{
+		"namespaces": []interface{}{"kube-system", "monitoring"},
+		"thresholds": map[string]interface{}{
+			"cpu":    80,
+			"memory": 90,
+			"teams":  map[string]interface{}{"storage": 5},
+		},
+		"extra+": []interface{}{"resolved"},
+	}}
+
+	cases := []struct {
+		override Values
+		expected map[string]interface{}
+	}{
+		{
+			Values{Values: map[string]interface{}{
+				"thresholds": map[string]interface{}{"cpu": 95, "teams": map[string]interface{}{"network": 7}},
+			}},
+			map[string]interface{}{
+				"namespaces": []interface{}{"kube-system", "monitoring"},
+				"thresholds": map[string]interface{}{
+					"cpu":    95,
+					"memory": 90,
+					"teams":  map[string]interface{}{"storage": 5, "network": 7},
+				},
+				"extra": []interface{}{"resolved"},
+			},
+		},
+		{
+			Values{Values: map[string]interface{}{"namespaces": []interface{}{"gpu"}}},
+			map[string]interface{}{
+				"namespaces": []interface{}{"gpu"},
+				"thresholds": defaults.Values["thresholds"],
+				"extra":      []interface{}{"resolved"},
+			},
+		},
+		{
+			Values{Values: map[string]interface{}{"namespaces+": []interface{}{"gpu"}}},
+			map[string]interface{}{
+				"namespaces": []interface{}{"kube-system", "monitoring", "gpu"},
+				"thresholds": defaults.Values["thresholds"],
+				"extra":      []interface{}{"resolved"},
+			},
+		},
+	}
+
+	for ix, test := range cases {
+		seen := mergeValues(defaults, test.override)
+		if !reflect.DeepEqual(seen.Values, test.expected) {
+			t.Errorf("Test case %d, seen and expected do not match (seen: %v  expected: %v)", ix, seen.Values, test.expected)
+		}
+	}
+
+	// Merging must not modify the inputs
+	if len(defaults.Values["namespaces"].([]interface{})) != 2 {
+		t.Errorf("Merging modified the default namespaces, %v", defaults.Values["namespaces"])
+	}
+	if len(defaults.Values["thresholds"].(map[string]interface{})["teams"].(map[string]interface{})) != 1 {
+		t.Errorf("Merging modified the default teams, %v", defaults.Values["thresholds"])
+	}
+}
+
 func compareFiles(seenName, expectedName string) bool {
 	seenFile, err := os.Open(seenName)
 	if err != nil {
@@ -128,7 +197,7 @@ func compareFiles(seenName, expectedName string) bool {
 func TestInternalTemplateExpansionContext1(t *testing.T) {
 	cleanup := true
 	DefaultTempDirectory = "testdata/output"
-	tpl, err := createInternalTemplate("testdata/testdir1")
+	tpl, err := createInternalTemplate("testdata/testdir1", Options{Strict: true})
 	if err != nil {
 		t.Errorf("Unexpected error, %s", err)
 	}
@@ -138,13 +207,13 @@ func TestInternalTemplateExpansionContext1(t *testing.T) {
 	}
 
 	for _, key := range []string{"default", "context1"} {
-		if _, ok := tpl.variables[key]; !ok {
+		if _, ok := tpl.variables["."][key]; !ok {
 			t.Errorf("context variables for %s not present.", key)
 		}
 	}
 
-	if len(tpl.variables) != 2 {
-		t.Errorf("Unexpected number of context variable settings, expected 2, saw %d", len(tpl.variables))
+	if len(tpl.variables["."]) != 2 {
+		t.Errorf("Unexpected number of context variable settings, expected 2, saw %d", len(tpl.variables["."]))
 	}
 
 	context1Data, err := expandDirectory("context1", tpl)
@@ -169,7 +238,7 @@ func TestInternalTemplateExpansionContext1(t *testing.T) {
 func TestInternalTemplateExpansionContextWithRandomDirectory(t *testing.T) {
 	cleanup := true
 	DefaultTempDirectory = fmt.Sprintf("testdata/output-%d", rand.Uint32())
-	tpl, err := createInternalTemplate("testdata/testdir1")
+	tpl, err := createInternalTemplate("testdata/testdir1", Options{Strict: true})
 	if err != nil {
 		t.Errorf("Unexpected error, %s", err)
 	}
@@ -179,13 +248,13 @@ func TestInternalTemplateExpansionContextWithRandomDirectory(t *testing.T) {
 	}
 
 	for _, key := range []string{"default", "context1"} {
-		if _, ok := tpl.variables[key]; !ok {
+		if _, ok := tpl.variables["."][key]; !ok {
 			t.Errorf("context variables for %s not present.", key)
 		}
 	}
 
-	if len(tpl.variables) != 2 {
-		t.Errorf("Unexpected number of context variable settings, expected 2, saw %d", len(tpl.variables))
+	if len(tpl.variables["."]) != 2 {
+		t.Errorf("Unexpected number of context variable settings, expected 2, saw %d", len(tpl.variables["."]))
 	}
 
 	context1Data, err := expandDirectory("context1", tpl)
@@ -206,3 +275,420 @@ func TestInternalTemplateExpansionContextWithRandomDirectory(t *testing.T) {
 		context1Data.Cleanup()
 	}
 }
+
+func TestNestedValuesExpansion(t *testing.T) {
+	cleanup := true
+	DefaultTempDirectory = "testdata/output"
+	data, err := ExpandDirectory([]string{"context1"}, "testdata/testdir2", Options{Strict: true})
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	context1Data := data["context1"]
+	for _, name := range context1Data.Files {
+		seenName := filepath.Join(context1Data.Directory, name)
+		expectedName := filepath.Join("testdata/expected/testdir2-context1", name)
+		if !compareFiles(seenName, expectedName) {
+			t.Errorf("Unexpected file difference, seen path: %s, expected path = %s, please manually diff", seenName, expectedName)
+			cleanup = false
+		}
+	}
+
+	if cleanup {
+		context1Data.Cleanup()
+	}
+}
+
+func TestRecursiveExpansion(t *testing.T) {
+	cleanup := true
+	DefaultTempDirectory = "testdata/output"
+	data, err := ExpandDirectory([]string{"context1"}, "testdata/testdir4", Options{Strict: true})
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	context1Data := data["context1"]
+	expected := []string{
+		filepath.Join("databases", "postgres", "rules.yaml"),
+		"rules.yaml",
+		filepath.Join("databases", "tests", "postgres.yaml"),
+	}
+	if !reflect.DeepEqual(context1Data.Files, expected) {
+		t.Errorf("Saw files %v, expected %v", context1Data.Files, expected)
+	}
+
+	for _, name := range context1Data.Files {
+		seenName := filepath.Join(context1Data.Directory, name)
+		expectedName := filepath.Join("testdata/expected/testdir4-context1", name)
+		if !compareFiles(seenName, expectedName) {
+			t.Errorf("Unexpected file difference, seen path: %s, expected path = %s, please manually diff", seenName, expectedName)
+			cleanup = false
+		}
+	}
+
+	if cleanup {
+		context1Data.Cleanup()
+	}
+}
+
+func TestIsTestFile(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected bool
+	}{
+		{"rules.yaml", false},
+		{filepath.Join("tests", "rules.yaml"), true},
+		{filepath.Join("a", "b", "tests", "rules.yaml"), true},
+		{filepath.Join("tests", "sub", "rules.yaml"), true},
+		{filepath.Join("contests", "rules.yaml"), false},
+	}
+
+	for ix, td := range cases {
+		if seen := IsTestFile(td.name); seen != td.expected {
+			t.Errorf("Case #%d, %s: saw %v, expected %v", ix, td.name, seen, td.expected)
+		}
+	}
+}
+
+func TestManifestLayering(t *testing.T) {
+	cleanup := true
+	DefaultTempDirectory = "testdata/output"
+	data, err := ExpandDirectory([]string{"prod-eu-1"}, "testdata/testdir5", Options{Strict: true})
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	context1Data := data["prod-eu-1"]
+	if !reflect.DeepEqual(context1Data.Files, []string{"rules.yaml"}) {
+		t.Errorf("Unexpected files %v, the manifest should not be expanded", context1Data.Files)
+	}
+	if context1Data.Values.Values["pager"] != "prod-eu-oncall" || context1Data.Values.Values["context"] != "prod-eu-1" {
+		t.Errorf("Unexpected values %v", context1Data.Values.Values)
+	}
+	for _, name := range context1Data.Files {
+		seenName := filepath.Join(context1Data.Directory, name)
+		expectedName := filepath.Join("testdata/expected/testdir5-prod-eu-1", name)
+		if !compareFiles(seenName, expectedName) {
+			t.Errorf("Unexpected file difference, seen path: %s, expected path = %s, please manually diff", seenName, expectedName)
+			cleanup = false
+		}
+	}
+
+	if cleanup {
+		context1Data.Cleanup()
+	}
+}
+
+func TestManifestSelect(t *testing.T) {
+	manifest, err := LoadManifest("testdata/testdir5", Options{Strict: true})
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	cases := []struct {
+		names    []string
+		selector string
+		expected []string
+		fail     bool
+	}{
+		{[]string{"prod-us-1", "dev-eu-1"}, "", []string{"prod-us-1", "dev-eu-1"}, false},
+		{[]string{"eu"}, "", []string{"dev-eu-1", "prod-eu-1"}, false},
+		{[]string{"gpu-hardware", "prod-eu-1"}, "", []string{"prod-eu-1"}, false},
+		{[]string{"elsewhere"}, "", []string{"elsewhere"}, false},
+		{[]string{""}, "environment=production", []string{"prod-eu-1", "prod-us-1"}, false},
+		{[]string{"dev-eu-1"}, "region=eu,environment!=development", []string{"dev-eu-1", "prod-eu-1"}, false},
+		{nil, "environment in (", nil, true},
+	}
+
+	for ix, td := range cases {
+		seen, err := manifest.Select(td.names, td.selector)
+		if (err != nil) != td.fail {
+			t.Errorf("Case #%d, unexpected error status, %v", ix, err)
+			continue
+		}
+		if !reflect.DeepEqual(seen, td.expected) {
+			t.Errorf("Case #%d, saw %v, expected %v", ix, seen, td.expected)
+		}
+	}
+
+	var none *Manifest
+	if _, err := none.Select(nil, "environment=production"); err == nil {
+		t.Errorf("Expected an error selecting by label without a manifest")
+	}
+	if seen, _ := none.Select([]string{"a", "b"}, ""); !reflect.DeepEqual(seen, []string{"a", "b"}) {
+		t.Errorf("Saw %v without a manifest, expected [a b]", seen)
+	}
+}
+
+func TestManifestLabel(t *testing.T) {
+	manifest, err := LoadManifest("testdata/testdir5", Options{Strict: true})
+	if err != nil {
+		t.Fatalf("Unexpected error, %s", err)
+	}
+
+	cases := []struct {
+		manifest       *Manifest
+		context, label string
+		expected       string
+	}{
+		{manifest, "prod-us-1", NamespaceLabel, "prometheus-system"},
+		{manifest, "prod-eu-1", NamespaceLabel, ""},
+		{manifest, "prod-eu-1", "region", "eu"},
+		{manifest, "elsewhere", NamespaceLabel, ""},
+		{nil, "prod-us-1", NamespaceLabel, ""},
+	}
+
+	for ix, td := range cases {
+		if seen := td.manifest.Label(td.context, td.label); seen != td.expected {
+			t.Errorf("Case #%d, saw %q, expected %q", ix, seen, td.expected)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	cases := []struct {
+		data string
+		fail bool
+	}{
+		{"layers: [region]\ncontexts:\n  a:\n    region: eu\n", false},
+		{"layers: [region]\ncontexts:\n  a:\n    region: default\n", true},
+		{"layers: [region]\ncontexts:\n  a:\n    region: b\n  b:\n    region: eu\n", true},
+		{"layers: ['']\ncontexts: {}\n", true},
+	}
+
+	for ix, td := range cases {
+		_, err := parseManifest("contexts.yaml", []byte(td.data), true)
+		if (err != nil) != td.fail {
+			t.Errorf("Case #%d, unexpected error status, %v", ix, err)
+		}
+	}
+}
+
+func TestExpandTests(t *testing.T) {
+	DefaultTempDirectory = "testdata/output"
+
+	cases := []struct {
+		expand   bool
+		expected string
+	}{
+		{false, "testdata/testdir6/tests/rules.yaml"},
+		{true, "testdata/expected/testdir6-context1/tests/rules.yaml"},
+	}
+
+	for ix, td := range cases {
+		data, err := ExpandDirectory([]string{"context1"}, "testdata/testdir6", Options{Strict: true, ExpandTests: td.expand})
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error, %s", ix, err)
+			continue
+		}
+		context1Data := data["context1"]
+		seenName := filepath.Join(context1Data.Directory, "tests", "rules.yaml")
+		if !compareFiles(seenName, td.expected) {
+			t.Errorf("Case #%d, unexpected file difference, seen path: %s, expected path = %s, please manually diff", ix, seenName, td.expected)
+			continue
+		}
+		context1Data.Cleanup()
+	}
+}
+
+func TestTemplateFunctions(t *testing.T) {
+	values := map[string]interface{}{
+		"namespaces": []interface{}{"kube-system", "my.app"},
+		"threshold":  80,
+		"ratio":      0.5,
+		"empty":      "",
+		"team":       map[string]interface{}{"name": "storage", "pager": "storage-oncall"},
+	}
+
+	cases := []struct {
+		template string
+		expected string
+		fail     bool
+	}{
+		{`<{[ upper "abc" ]}>`, "ABC", false},
+		{`<{[ lower "ABC" ]}>`, "abc", false},
+		{`<{[ title "node down" ]}>`, "Node Down", false},
+		{`<{[ trim "  x  " ]}>`, "x", false},
+		{`<{[ "foo-bar" | trimPrefix "foo-" ]}>`, "bar", false},
+		{`<{[ "foo-bar" | trimSuffix "-bar" ]}>`, "foo", false},
+		{`<{[ "a.b.c" | replace "." "_" ]}>`, "a_b_c", false},
+		{`<{[ "kube-system" | contains "system" ]}>`, "true", false},
+		{`<{[ "kube-system" | hasPrefix "kube" ]}>`, "true", false},
+		{`<{[ "kube-system" | hasSuffix "kube" ]}>`, "false", false},
+		{`<{[ split "," "a,b" | join "|" ]}>`, "a|b", false},
+		{`<{[ join ", " .namespaces ]}>`, "kube-system, my.app", false},
+		{`<{[ quote .team.name ]}>`, `"storage"`, false},
+		{`<{[ squote .threshold ]}>`, `'80'`, false},
+		{`<{[ regexQuote "my.app" ]}>`, `my\\.app`, false},
+		{`<{[ regexQuote "a\"b" ]}>`, `a\"b`, false},
+		{`<{[ regexAlternation .namespaces ]}>`, `kube-system|my\\.app`, false},
+		{`<{[ regexAlternation .threshold ]}>`, "", true},
+		{`<{[ .missing | default "fallback" ]}>`, "fallback", false},
+		{`<{[ .empty | default "fallback" ]}>`, "fallback", false},
+		{`<{[ .threshold | default 10 ]}>`, "80", false},
+		{`<{[ .threshold | required "threshold must be set" ]}>`, "80", false},
+		{`<{[ .missing | required "missing must be set" ]}>`, "", true},
+		{`<{[ add .threshold 5 ]}>`, "85", false},
+		{`<{[ sub .threshold 5 ]}>`, "75", false},
+		{`<{[ mul .threshold .ratio ]}>`, "40", false},
+		{`<{[ mul .threshold 2 ]}>`, "160", false},
+		{`<{[ div .threshold 100 ]}>`, "0.8", false},
+		{`<{[ div .threshold 0 ]}>`, "", true},
+		{`<{[ mod 7 3 ]}>`, "1", false},
+		{`<{[ mod 7.5 3 ]}>`, "", true},
+		{`<{[ max 1 .threshold 3 ]}>`, "80", false},
+		{`<{[ min 1 .threshold .ratio ]}>`, "0.5", false},
+		{`<{[ add "x" 1 ]}>`, "", true},
+		{`<{[ int "42.9" ]}>`, "42", false},
+		{`<{[ float 3 ]}>`, "3", false},
+		{`<{[ durationSeconds "5m" ]}>`, "300", false},
+		{`<{[ durationSeconds "1d" ]}>`, "86400", false},
+		{`<{[ durationSeconds "five minutes" ]}>`, "", true},
+		{`<{[ formatDuration 3600 ]}>`, "1h", false},
+		{`<{[ durationSeconds "10m" | mul 2 | formatDuration ]}>`, "20m", false},
+		{`<{[ range list "a" "b" ]}><{[ . ]}><{[ end ]}>`, "ab", false},
+		{`<{[ (dict "a" 1 "b" 2).b ]}>`, "2", false},
+		{`<{[ dict "a" ]}>`, "", true},
+		{`<{[ keys .team | join "," ]}>`, "name,pager", false},
+		{`<{[ hasKey .team "pager" ]}>`, "true", false},
+		{`<{[ has "kube-system" .namespaces ]}>`, "true", false},
+		{`<{[ has "default" .namespaces ]}>`, "false", false},
+		{`<{[ .namespaces | has "my.app" ]}>`, "true", false},
+		{`<{[ concat .namespaces (list "default") | join "," ]}>`, "kube-system,my.app,default", false},
+		{`<{[ toYaml .team ]}>`, "name: storage\npager: storage-oncall", false},
+		{`<{[ toYaml .team | indent 2 ]}>`, "  name: storage\n  pager: storage-oncall", false},
+		{`x:<{[ toYaml .team | nindent 2 ]}>`, "x:\n  name: storage\n  pager: storage-oncall", false},
+	}
+
+	for ix, test := range cases {
+		tmpl, err := template.New("test").Delims("<{[", "]}>").Funcs(funcMap()).Parse(test.template)
+		if err != nil {
+			t.Errorf("Test case %d, failed to parse %s: %s", ix, test.template, err)
+			continue
+		}
+		var out bytes.Buffer
+		err = tmpl.Execute(&out, values)
+		if (err != nil) != test.fail {
+			t.Errorf("Test case %d, %s, unexpected error status, (err != nil) is %v, expected %v (%v)", ix, test.template, err != nil, test.fail, err)
+			continue
+		}
+		if !test.fail && out.String() != test.expected {
+			t.Errorf("Test case %d, %s, saw %q expected %q", ix, test.template, out.String(), test.expected)
+		}
+	}
+}
+
+func TestMissingValues(t *testing.T) {
+	DefaultTempDirectory = "testdata/output"
+
+	// Nothing defines memory_threshold for other.yaml, nor runbook_url
+	// for rules.yaml, and context2 lacks gpu_threshold too. Every
+	// missing value is reported, not only the first in each file.
+	data, err := ExpandDirectory([]string{"context1", "context2"}, "testdata/testdir3", Options{Strict: true})
+	for _, d := range data {
+		d.Cleanup()
+	}
+	errs, ok := err.(ExpansionErrors)
+	if !ok {
+		t.Fatalf("Expected ExpansionErrors, saw %v", err)
+	}
+	expected := []string{
+		`context context1: template: other.yaml:5:40: executing "other.yaml" at <.Values.memory_threshold>: map has no entry for key "memory_threshold"`,
+		`context context1: template: rules.yaml:10:34: executing "rules.yaml" at <.Values.runbook_url>: map has no entry for key "runbook_url"`,
+		`context context2: template: other.yaml:5:40: executing "other.yaml" at <.Values.memory_threshold>: map has no entry for key "memory_threshold"`,
+		`context context2: template: rules.yaml:8:37: executing "rules.yaml" at <.Values.gpu_threshold>: map has no entry for key "gpu_threshold"`,
+		`context context2: template: rules.yaml:10:34: executing "rules.yaml" at <.Values.runbook_url>: map has no entry for key "runbook_url"`,
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Saw %d errors, expected %d:\n%s", len(errs), len(expected), errs)
+	}
+	for ix := range expected {
+		if errs[ix].Error() != expected[ix] {
+			t.Errorf("Error %d, saw %s\nexpected %s", ix, errs[ix], expected[ix])
+		}
+	}
+
+	data, err = ExpandDirectory([]string{"context1", "context2"}, "testdata/testdir3", Options{Strict: true, AllowMissingValues: true})
+	for _, d := range data {
+		d.Cleanup()
+	}
+	if err != nil {
+		t.Errorf("Unexpected error with missing values allowed, %s", err)
+	}
+}
+
+func TestOptionalValues(t *testing.T) {
+	values := Values{Values: map[string]interface{}{
+		"threshold": 80,
+		"team":      map[string]interface{}{"name": "storage"},
+		"teams":     []interface{}{map[string]interface{}{"name": "a"}, map[string]interface{}{"name": "b", "pager": "b-oncall"}},
+	}}
+
+	cases := []struct {
+		template string
+		expected string
+		fail     bool
+	}{
+		{`<{[ .Values.threshold | default 10 ]}>`, "80", false},
+		{`<{[ .Values.missing | default 10 ]}>`, "10", false},
+		{`<{[ default 10 .Values.missing ]}>`, "10", false},
+		{`<{[ $.Values.missing | default 10 ]}>`, "10", false},
+		{`<{[ .Values.team.missing | default "x" ]}>`, "x", false},
+		{`<{[ .Values.missing.name | default "x" ]}>`, "x", false},
+		{`<{[ .Values.missing | default 2 | add 1 ]}>`, "3", false},
+		{`<{[ add 1 (.Values.missing | default 2) ]}>`, "3", false},
+		{`<{[ range .Values.teams ]}><{[ .pager | default .name ]}>,<{[ end ]}>`, "a,b-oncall,", false},
+		{`<{[ .Values.threshold | required "threshold must be set" ]}>`, "80", false},
+		{`<{[ .Values.missing | required "missing must be set" ]}>`, "", true},
+		{`<{[ .Values.missing ]}>`, "", true},
+		{`<{[ .Values.missing | quote ]}>`, "", true},
+	}
+
+	for ix, test := range cases {
+		tmpl, err := template.New("test").Delims("<{[", "]}>").Funcs(funcMap()).Option("missingkey=error").Parse(test.template)
+		if err != nil {
+			t.Errorf("Test case %d, failed to parse %s: %s", ix, test.template, err)
+			continue
+		}
+		rewriteOptional(tmpl)
+		var out bytes.Buffer
+		err = tmpl.Execute(&out, values)
+		if (err != nil) != test.fail {
+			t.Errorf("Test case %d, %s, unexpected error status, (err != nil) is %v, expected %v (%v)", ix, test.template, err != nil, test.fail, err)
+			continue
+		}
+		if !test.fail && out.String() != test.expected {
+			t.Errorf("Test case %d, %s, saw %q expected %q", ix, test.template, out.String(), test.expected)
+		}
+	}
+}
+
+func TestMissingKeys(t *testing.T) {
+	values := Values{Values: map[string]interface{}{
+		"threshold": 80,
+		"team":      map[string]interface{}{"name": "storage"},
+	}}
+	text := `<{[ .Values.a ]}> <{[ $.Values.team.b ]}> <{[ .Values.c | default 1 ]}>
+<{[ if .Values.d ]}><{[ .Values.e ]}><{[ end ]}>
+<{[ if and .Values.threshold .Values.f ]}><{[ end ]}>
+<{[ add 1 (.Values.g) ]}> <{[ .Values.threshold.h ]}> <{[ .Values.team.name ]}>`
+
+	tmpl, err := template.New("test").Delims("<{[", "]}>").Funcs(funcMap()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		t.Fatalf("Failed to parse, %s", err)
+	}
+	rewriteOptional(tmpl)
+	var seen []string
+	for _, err := range missingKeys(tmpl, values) {
+		seen = append(seen, err.Error())
+	}
+	expected := []string{
+		`template: test:1:11: executing "test" at <.Values.a>: map has no entry for key "a"`,
+		`template: test:1:23: executing "test" at <$.Values.team.b>: map has no entry for key "b"`,
+		`template: test:2:14: executing "test" at <.Values.d>: map has no entry for key "d"`,
+		`template: test:4:18: executing "test" at <.Values.g>: map has no entry for key "g"`,
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Saw:\n%s\nexpected:\n%s", strings.Join(seen, "\n"), strings.Join(expected, "\n"))
+	}
+}